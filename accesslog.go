@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// openAccessLog returns the destination for combined access logs: stdout for
+// "" or "-", stderr for "stderr", otherwise a file opened for appending.
+func openAccessLog(dest string) (io.Writer, error) {
+	switch dest {
+	case "", "-", "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	}
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open access log: %w", err)
+	}
+	return f, nil
+}
+
+// combinedLogLine formats r in NCSA combined log format. The request line uses
+// the redacted path so stream tokens never reach the access log.
+func combinedLogLine(clientIP string, r *http.Request, status int, size int64, at time.Time) string {
+	bytes := "-"
+	if size > 0 {
+		bytes = strconv.FormatInt(size, 10)
+	}
+	return fmt.Sprintf("%s - - [%s] %s %d %s %s %s\n",
+		clientIP,
+		at.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(r.Method+" "+redactPath(r.URL.Path)+" "+r.Proto),
+		status,
+		bytes,
+		quoteOrDash(r.Referer()),
+		quoteOrDash(r.UserAgent()),
+	)
+}
+
+// quoteOrDash quotes a header value for the access log, or returns "-" when empty.
+func quoteOrDash(v string) string {
+	if strings.TrimSpace(v) == "" {
+		return `"-"`
+	}
+	return strconv.Quote(v)
+}
@@ -1,76 +1,801 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
+	"fmt"
 	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
 )
 
 type Config struct {
-	ListenAddr   string
-	WowzaWSURL   string
-	AllowedHosts string // Comma-separated list, supports wildcards like *.wowza.com
+	ListenAddr    string
+	SocketMode    string // Octal permissions for a unix: ListenAddr socket
+	BasePath      string // Route prefix when served under a sub-path, e.g. /wowzabridge
+	PublicBaseURL string // Scheme and host prepended to Location headers, e.g. https://whep.example.com
+	WowzaWSURL    string // Static mode upstream; comma-separated URLs fail over in order
+	AllowedHosts  string // Comma-separated list, supports wildcards like *.wowza.com
 
-	WsTimeout time.Duration
-	InsecureTLS  bool
-	Verbose      bool
-	LogFormat    string
+	AllowedApps    string // Comma-separated Wowza application globs like live or live-*
+	AllowedStreams string // Comma-separated app/stream globs like live/*; "!" prefix denies
+
+	WsTimeout       time.Duration
+	WsPingInterval  time.Duration // Ping Wowza this often while waiting on signaling replies; 0 disables
+	WsIdleTimeout   time.Duration // Close a KeepWSOpen connection after this long without signaling; 0 disables
+	ShutdownTimeout time.Duration // Total budget for HTTP shutdown plus session drain
+	DialRetries     int           // Extra attempts for dial + getOffer on transport errors
+	DialBackoff     time.Duration // Initial retry delay, doubled per attempt
+	SessionTTL      time.Duration // Idle sessions older than this are reaped; 0 disables
+	MediaWait       time.Duration // After negotiation, reap unless a keepalive PATCH arrives within this; 0 disables
+
+	// Per-phase signaling deadlines within WsTimeout; 0 derives them from WsTimeout
+	DialTimeout      time.Duration // WebSocket handshake; defaults to half of WsTimeout
+	OfferTimeout     time.Duration // getOffer round-trip
+	CandidateTimeout time.Duration // sendResponse and Wowza's candidate replies
+
+	MaxSessions               int // Maximum concurrent sessions; 0 means unlimited
+	MaxConcurrentNegotiations int // Maximum simultaneous Wowza exchanges; 0 means unlimited
+
+	ParallelUpstreams int // Static failover upstreams dialed at once, first 2xx offer wins; <= 1 tries them in order
+
+	MaxOfferSize        int // Bytes accepted for an SDP offer
+	MaxFragmentSize     int // Bytes accepted for a trickle ICE fragment
+	MaxWowzaMessageSize int // Bytes accepted for one Wowza websocket message; <= 0 is unlimited
+
+	PerHostRate  float64 // Session creations per second per Wowza host; 0 disables
+	PerHostBurst int
+
+	RetryAfter time.Duration // Base Retry-After on failed creates, growing with repeated failures per host; 0 disables
+
+	AuthToken string // Bearer token required on WHEP requests; env only to keep it out of process listings
+
+	WebhookURL string // Receives session lifecycle events; empty disables
+
+	TrustedProxies string // Comma-separated CIDRs or IPs whose X-Forwarded-For is believed
+
+	ForwardHeaders string // Comma-separated request headers sent to Wowza as userData; "Prefix-*" matches a prefix
+
+	WowzaHeaders string // Comma-separated Key=Value headers sent on the Wowza websocket dial
+
+	WowzaSubprotocol string // Sec-WebSocket-Protocol required from Wowza; empty sends none
+
+	WowzaProxyURL string // http:// (CONNECT) or socks5:// proxy for the Wowza websocket; empty dials directly
+
+	WowzaCompression bool // Offer permessage-deflate on the Wowza websocket
+	StrictOfferType  bool // Fail getOffer replies whose SDP type isn't "offer" instead of warning
+
+	AllowedOrigins string // Comma-separated CORS origins, or "*" for any
+
+	ICEServers string // Comma-separated STUN/TURN URLs advertised in Link headers; TURN may embed user:pass@
+
+	CodecPreference string // Comma-separated video codecs the "any" route picks from, most preferred first
+
+	RelayOnly bool // Only hand clients Wowza's TURN relay candidates
+
+	KeepWowzaCandidates bool // Keep Wowza's candidates in the answer sent back to Wowza
+
+	KeepWSOpen bool // Keep the Wowza websocket open after negotiation for trickle ICE both ways
+
+	MaxVideoBitrate int // kbps cap advertised to clients as b=AS on video; <= 0 disables
+
+	// playout-delay bounds added to client answers when Wowza doesn't offer the
+	// extension; both zero disables
+	MinPlayoutDelay time.Duration
+	MaxPlayoutDelay time.Duration
+
+	ReorderCandidates bool // Rewrite Wowza candidate priorities so UDP host wins over TCP relay
+
+	RewriteMsid bool // Derive client answer msids from the mid instead of copying Wowza's
+
+	CandidateIPMap string // Comma-separated private=public IPs rewritten in Wowza's candidates, for 1:1 NAT
+
+	DTLSRole string // DTLS setup role written into the client answer: passive, active or auto
+
+	SynthesizeMids bool // Number client media sections lacking a=mid instead of rejecting the offer
+
+	SDPSessionName   string // s= line written into client answers
+	SDPOriginAddress string // o= unicast address written into client answers; empty uses 127.0.0.1
+
+	TLSCert       string // PEM certificate for HTTPS; requires TLSKey
+	TLSKey        string
+	TLSMinVersion string // 1.2 or 1.3
+	EnableH2C     bool   // Accept HTTP/2 over cleartext for proxies that speak h2c
+
+	FilterIPv6  bool // Drop all IPv6 client candidates; Wowza Cloud can't use them
+	InsecureTLS bool
+	Metrics     bool
+	StaticDir   string // Served at /static/ when set; empty disables
+	Debug       bool   // Enables POST /whep/validate
+	PprofAddr   string // Separate listener for /debug/pprof/; empty disables
+	Verbose     bool
+	LogFormat   string
+	LogFields   string // Static attributes on every log line, comma-separated key=value
+	LogRename   string // Built-in log keys to rename, e.g. msg=message,level=severity
+
+	AccessLogFormat string // slog, or combined for NCSA combined log lines
+	AccessLog       string // Combined log destination: -, stderr or a file path
+
+	LogSDPOnFailure bool // Log the negotiation's offers and answers at error level when it fails
+
+	ConfigFile string // KEY=VALUE file re-read for the reloadable fields on SIGHUP or POST /admin/reload
+
+	mu sync.RWMutex // Guards the fields Reload replaces
 }
 
 func NewConfig() *Config {
 	c := &Config{
-		ListenAddr:   env("LISTEN_ADDR", ":8080"),
-		WowzaWSURL:   env("WOWZA_WEBSOCKET_URL", ""),
-		AllowedHosts: env("ALLOWED_HOSTS", ""),
-		WsTimeout:    envDuration("WS_TIMEOUT", 30*time.Second),
-		InsecureTLS:  envBool("INSECURE_TLS", false),
-		Verbose:      envBool("VERBOSE", false),
-		LogFormat:    env("LOG_FORMAT", "auto"),
+		ListenAddr:                env("LISTEN_ADDR", ":8080"),
+		SocketMode:                env("SOCKET_MODE", "0660"),
+		BasePath:                  env("BASE_PATH", ""),
+		PublicBaseURL:             env("PUBLIC_BASE_URL", ""),
+		WowzaWSURL:                env("WOWZA_WEBSOCKET_URL", ""),
+		AllowedHosts:              env("ALLOWED_HOSTS", ""),
+		AllowedApps:               env("ALLOWED_APPS", ""),
+		AllowedStreams:            env("ALLOWED_STREAMS", ""),
+		WsTimeout:                 envDuration("WS_TIMEOUT", 30*time.Second),
+		WsIdleTimeout:             envDuration("WS_IDLE_TIMEOUT", 30*time.Second),
+		DialTimeout:               envDuration("DIAL_TIMEOUT", 0),
+		OfferTimeout:              envDuration("OFFER_TIMEOUT", 0),
+		CandidateTimeout:          envDuration("CANDIDATE_TIMEOUT", 0),
+		WsPingInterval:            envDuration("WS_PING_INTERVAL", 5*time.Second),
+		ShutdownTimeout:           envDuration("SHUTDOWN_TIMEOUT", 10*time.Second),
+		DialRetries:               envInt("DIAL_RETRIES", 2),
+		DialBackoff:               envDuration("DIAL_BACKOFF", 250*time.Millisecond),
+		SessionTTL:                envDuration("SESSION_TTL", 5*time.Minute),
+		MediaWait:                 envDuration("MEDIA_WAIT", 0),
+		MaxSessions:               envInt("MAX_SESSIONS", 0),
+		MaxConcurrentNegotiations: envInt("MAX_CONCURRENT_NEGOTIATIONS", 0),
+		ParallelUpstreams:         envInt("PARALLEL_UPSTREAMS", 1),
+		MaxOfferSize:              envInt("MAX_OFFER_SIZE", 64*1024),
+		MaxFragmentSize:           envInt("MAX_FRAGMENT_SIZE", 4*1024),
+		MaxWowzaMessageSize:       envInt("MAX_WOWZA_MESSAGE_SIZE", 1024*1024),
+		PerHostRate:               envFloat("PER_HOST_RATE", 0),
+		PerHostBurst:              envInt("PER_HOST_BURST", 10),
+		RetryAfter:                envDuration("RETRY_AFTER", 2*time.Second),
+		AuthToken:                 env("AUTH_TOKEN", ""),
+		WebhookURL:                env("WEBHOOK_URL", ""),
+		TrustedProxies:            env("TRUSTED_PROXIES", ""),
+		ForwardHeaders:            env("FORWARD_HEADERS", "X-Forwarded-For,UserData-*"),
+		WowzaHeaders:              env("WOWZA_HEADERS", ""),
+		WowzaSubprotocol:          env("WOWZA_SUBPROTOCOL", ""),
+		WowzaProxyURL:             env("WOWZA_PROXY_URL", ""),
+		WowzaCompression:          envBool("WOWZA_COMPRESSION", false),
+		StrictOfferType:           envBool("STRICT_OFFER_TYPE", false),
+		AllowedOrigins:            env("ALLOWED_ORIGINS", "*"),
+		ICEServers:                env("ICE_SERVERS", ""),
+		CodecPreference:           env("CODEC_PREFERENCE", "h264,vp8,vp9,h265"),
+		DTLSRole:                  env("DTLS_ROLE", "passive"),
+		SynthesizeMids:            envBool("SYNTHESIZE_MIDS", false),
+		SDPSessionName:            env("SDP_SESSION_NAME", "-"),
+		SDPOriginAddress:          env("SDP_ORIGIN_ADDRESS", ""),
+		RelayOnly:                 envBool("RELAY_ONLY", false),
+		KeepWowzaCandidates:       envBool("KEEP_WOWZA_CANDIDATES", false),
+		KeepWSOpen:                envBool("KEEP_WS_OPEN", false),
+		MaxVideoBitrate:           envInt("MAX_VIDEO_BITRATE", 0),
+		MinPlayoutDelay:           envDuration("MIN_PLAYOUT_DELAY", 0),
+		MaxPlayoutDelay:           envDuration("MAX_PLAYOUT_DELAY", 0),
+		ReorderCandidates:         envBool("REORDER_CANDIDATES", false),
+		RewriteMsid:               envBool("REWRITE_MSID", false),
+		CandidateIPMap:            env("CANDIDATE_IP_MAP", ""),
+		FilterIPv6:                envBool("FILTER_IPV6", true),
+		InsecureTLS:               envBool("INSECURE_TLS", false),
+		TLSCert:                   env("TLS_CERT", ""),
+		TLSKey:                    env("TLS_KEY", ""),
+		TLSMinVersion:             env("TLS_MIN_VERSION", "1.2"),
+		EnableH2C:                 envBool("ENABLE_H2C", false),
+		Metrics:                   envBool("METRICS", false),
+		StaticDir:                 env("STATIC_DIR", ""),
+		Debug:                     envBool("DEBUG", false),
+		PprofAddr:                 env("PPROF_ADDR", ""),
+		Verbose:                   envBool("VERBOSE", false),
+		LogSDPOnFailure:           envBool("LOG_SDP_ON_FAILURE", false),
+		LogFormat:                 env("LOG_FORMAT", "auto"),
+		LogFields:                 env("LOG_FIELDS", ""),
+		LogRename:                 env("LOG_RENAME", ""),
+		AccessLogFormat:           env("ACCESS_LOG_FORMAT", "slog"),
+		AccessLog:                 env("ACCESS_LOG", "-"),
+		ConfigFile:                env("CONFIG_FILE", ""),
 	}
 
-	flag.StringVar(&c.ListenAddr, "listen", c.ListenAddr, "HTTP listen address (env: LISTEN_ADDR)")
-	flag.StringVar(&c.WowzaWSURL, "websocket", c.WowzaWSURL, "Wowza WebSocket URL for static mode (env: WOWZA_WEBSOCKET_URL)")
+	flag.StringVar(&c.ListenAddr, "listen", c.ListenAddr, "HTTP listen address, or unix:/path for a Unix socket (env: LISTEN_ADDR)")
+	flag.StringVar(&c.SocketMode, "socket-mode", c.SocketMode, "Octal permissions for a Unix socket listener (env: SOCKET_MODE)")
+	flag.StringVar(&c.BasePath, "base-path", c.BasePath, "Prefix for all routes, e.g. /wowzabridge (env: BASE_PATH)")
+	flag.StringVar(&c.PublicBaseURL, "public-base-url", c.PublicBaseURL, "Absolute URL prepended to Location headers, e.g. https://whep.example.com; empty keeps them relative (env: PUBLIC_BASE_URL)")
+	flag.StringVar(&c.WowzaWSURL, "websocket", c.WowzaWSURL, "Wowza WebSocket URL for static mode, comma-separated for failover (env: WOWZA_WEBSOCKET_URL)")
 	flag.StringVar(&c.AllowedHosts, "allowed-hosts", c.AllowedHosts, "Allowed Wowza hosts, comma-separated, supports wildcards (env: ALLOWED_HOSTS)")
-	flag.DurationVar(&c.WsTimeout, "ws-timeout", c.WsTimeout, "WebSocket signaling timeout (env: WS_TIMEOUT)")
+	flag.StringVar(&c.AllowedApps, "allowed-apps", c.AllowedApps, "Allowed Wowza applications, comma-separated, supports wildcards (env: ALLOWED_APPS)")
+	flag.StringVar(&c.AllowedStreams, "allowed-streams", c.AllowedStreams, "Allowed app/stream globs, comma-separated, !pattern denies (env: ALLOWED_STREAMS)")
+	flag.DurationVar(&c.WsTimeout, "ws-timeout", c.WsTimeout, "Overall cap on one Wowza signaling exchange (env: WS_TIMEOUT)")
+	flag.DurationVar(&c.DialTimeout, "dial-timeout", c.DialTimeout, "Wowza WebSocket handshake timeout, 0 uses half of -ws-timeout (env: DIAL_TIMEOUT)")
+	flag.DurationVar(&c.OfferTimeout, "offer-timeout", c.OfferTimeout, "Timeout for Wowza's getOffer reply, 0 uses -ws-timeout (env: OFFER_TIMEOUT)")
+	flag.DurationVar(&c.CandidateTimeout, "candidate-timeout", c.CandidateTimeout, "Timeout for Wowza's sendResponse reply and candidates, 0 uses -ws-timeout (env: CANDIDATE_TIMEOUT)")
+	flag.DurationVar(&c.WsPingInterval, "ws-ping-interval", c.WsPingInterval, "Ping interval on the Wowza WebSocket; each pong extends the read deadline, 0 disables (env: WS_PING_INTERVAL)")
+	flag.DurationVar(&c.WsIdleTimeout, "ws-idle-timeout", c.WsIdleTimeout, "Close a kept-open Wowza WebSocket after this long without signaling, 0 disables (env: WS_IDLE_TIMEOUT)")
+	flag.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "Graceful shutdown budget; HTTP gets a third, sessions drain in the rest (env: SHUTDOWN_TIMEOUT)")
+	flag.IntVar(&c.DialRetries, "dial-retries", c.DialRetries, "Retries for Wowza dial and getOffer on transport errors (env: DIAL_RETRIES)")
+	flag.DurationVar(&c.DialBackoff, "dial-backoff", c.DialBackoff, "Initial backoff between Wowza dial retries (env: DIAL_BACKOFF)")
+	flag.DurationVar(&c.SessionTTL, "session-ttl", c.SessionTTL, "Idle session lifetime before reaping, 0 disables (env: SESSION_TTL)")
+	flag.DurationVar(&c.MediaWait, "media-wait", c.MediaWait, "Reap negotiated sessions without a keepalive PATCH in this window, 0 disables (env: MEDIA_WAIT)")
+	flag.IntVar(&c.MaxSessions, "max-sessions", c.MaxSessions, "Maximum concurrent sessions, 0 for unlimited (env: MAX_SESSIONS)")
+	flag.IntVar(&c.MaxConcurrentNegotiations, "max-concurrent-negotiations", c.MaxConcurrentNegotiations, "Maximum simultaneous Wowza signaling exchanges, 0 for unlimited (env: MAX_CONCURRENT_NEGOTIATIONS)")
+	flag.IntVar(&c.ParallelUpstreams, "parallel-upstreams", c.ParallelUpstreams, "Static failover upstreams to dial at once, using the first valid offer; 1 tries them in order (env: PARALLEL_UPSTREAMS)")
+	flag.IntVar(&c.MaxOfferSize, "max-offer-size", c.MaxOfferSize, "Maximum SDP offer size in bytes (env: MAX_OFFER_SIZE)")
+	flag.IntVar(&c.MaxFragmentSize, "max-fragment-size", c.MaxFragmentSize, "Maximum trickle ICE fragment size in bytes (env: MAX_FRAGMENT_SIZE)")
+	flag.IntVar(&c.MaxWowzaMessageSize, "max-wowza-message-size", c.MaxWowzaMessageSize, "Maximum size in bytes of one Wowza WebSocket message, 0 for unlimited (env: MAX_WOWZA_MESSAGE_SIZE)")
+	flag.Float64Var(&c.PerHostRate, "per-host-rate", c.PerHostRate, "Session creations per second per Wowza host, 0 disables (env: PER_HOST_RATE)")
+	flag.IntVar(&c.PerHostBurst, "per-host-burst", c.PerHostBurst, "Burst size for per-host rate limit (env: PER_HOST_BURST)")
+	flag.DurationVar(&c.RetryAfter, "retry-after", c.RetryAfter, "Base Retry-After on 502/503 signaling failures, doubled per repeated failure to a host, 0 disables (env: RETRY_AFTER)")
+	flag.StringVar(&c.WebhookURL, "webhook-url", c.WebhookURL, "URL to POST session lifecycle events to (env: WEBHOOK_URL)")
+	flag.StringVar(&c.TrustedProxies, "trusted-proxies", c.TrustedProxies, "Proxies whose X-Forwarded-For is trusted for client IPs, comma-separated CIDRs (env: TRUSTED_PROXIES)")
+	flag.StringVar(&c.ForwardHeaders, "forward-headers", c.ForwardHeaders, "Request headers forwarded to Wowza as userData, supports Prefix-* (env: FORWARD_HEADERS)")
+	flag.StringVar(&c.WowzaHeaders, "wowza-headers", c.WowzaHeaders, "Headers sent when dialing Wowza, comma-separated Key=Value (env: WOWZA_HEADERS)")
+	flag.StringVar(&c.WowzaSubprotocol, "wowza-subprotocol", c.WowzaSubprotocol, "WebSocket subprotocol to request from Wowza (env: WOWZA_SUBPROTOCOL)")
+	flag.StringVar(&c.WowzaProxyURL, "wowza-proxy", c.WowzaProxyURL, "Proxy for Wowza WebSocket connections: http://[user:pass@]host:port or socks5://[user:pass@]host:port (env: WOWZA_PROXY_URL)")
+	flag.BoolVar(&c.WowzaCompression, "wowza-compression", c.WowzaCompression, "Offer permessage-deflate compression on the Wowza WebSocket (env: WOWZA_COMPRESSION)")
+	flag.BoolVar(&c.StrictOfferType, "strict-offer-type", c.StrictOfferType, "Reject Wowza getOffer replies whose SDP type isn't offer instead of logging a warning (env: STRICT_OFFER_TYPE)")
+	flag.StringVar(&c.AllowedOrigins, "allowed-origins", c.AllowedOrigins, "Allowed CORS origins, comma-separated, * for any (env: ALLOWED_ORIGINS)")
+	flag.StringVar(&c.DTLSRole, "dtls-role", c.DTLSRole, "DTLS setup role in the client answer: passive, active, auto (env: DTLS_ROLE)")
+	flag.BoolVar(&c.SynthesizeMids, "synthesize-mids", c.SynthesizeMids, "Fill in a=mid for client media sections without one instead of rejecting the offer (env: SYNTHESIZE_MIDS)")
+	flag.StringVar(&c.SDPSessionName, "sdp-session-name", c.SDPSessionName, "Session name (s= line) of client answers (env: SDP_SESSION_NAME)")
+	flag.StringVar(&c.SDPOriginAddress, "sdp-origin-address", c.SDPOriginAddress, "IP address in the o= line of client answers, e.g. the gateway's public IP; empty uses 127.0.0.1 (env: SDP_ORIGIN_ADDRESS)")
+	flag.StringVar(&c.ICEServers, "ice-servers", c.ICEServers, "STUN/TURN servers advertised to clients, comma-separated, e.g. turn:user:pass@host:3478 (env: ICE_SERVERS)")
+	flag.StringVar(&c.CodecPreference, "codec-preference", c.CodecPreference, "Video codec order for the any route when Wowza and the client share several, empty uses Wowza's order (env: CODEC_PREFERENCE)")
+	flag.BoolVar(&c.RelayOnly, "relay-only", c.RelayOnly, "Keep only relay candidates from Wowza in client answers (env: RELAY_ONLY)")
+	flag.BoolVar(&c.KeepWowzaCandidates, "keep-wowza-candidates", c.KeepWowzaCandidates, "Keep Wowza's own candidates alongside the client's in the answer for Wowza (env: KEEP_WOWZA_CANDIDATES)")
+	flag.BoolVar(&c.KeepWSOpen, "keep-ws-open", c.KeepWSOpen, "Keep the Wowza WebSocket open after negotiation to relay trickle ICE both ways (env: KEEP_WS_OPEN)")
+	flag.IntVar(&c.MaxVideoBitrate, "max-video-bitrate", c.MaxVideoBitrate, "Video bitrate cap in kbps written as b=AS in client answers, 0 disables (env: MAX_VIDEO_BITRATE)")
+	flag.DurationVar(&c.MinPlayoutDelay, "min-playout-delay", c.MinPlayoutDelay, "Minimum playout delay advertised when the client offers playout-delay and Wowza doesn't (env: MIN_PLAYOUT_DELAY)")
+	flag.DurationVar(&c.MaxPlayoutDelay, "max-playout-delay", c.MaxPlayoutDelay, "Maximum playout delay advertised when the client offers playout-delay and Wowza doesn't (env: MAX_PLAYOUT_DELAY)")
+	flag.BoolVar(&c.ReorderCandidates, "reorder-candidates", c.ReorderCandidates, "Sort Wowza candidates UDP host > srflx > relay > TCP and rewrite priorities to match (env: REORDER_CANDIDATES)")
+	flag.BoolVar(&c.RewriteMsid, "rewrite-msid", c.RewriteMsid, "Replace Wowza's msid with stream-<mid> track-<mid> in client answers (env: REWRITE_MSID)")
+	flag.StringVar(&c.CandidateIPMap, "candidate-ip-map", c.CandidateIPMap, "Rewrite Wowza candidate IPs behind 1:1 NAT, comma-separated private=public, e.g. 10.0.0.5=203.0.113.5 (env: CANDIDATE_IP_MAP)")
+	flag.BoolVar(&c.FilterIPv6, "filter-ipv6", c.FilterIPv6, "Drop all IPv6 client candidates; when false keep global unicast IPv6 (env: FILTER_IPV6)")
 	flag.BoolVar(&c.InsecureTLS, "insecure-tls", c.InsecureTLS, "Skip TLS verification (env: INSECURE_TLS)")
+	flag.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "TLS certificate file; serves HTTPS together with -tls-key (env: TLS_CERT)")
+	flag.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "TLS private key file (env: TLS_KEY)")
+	flag.StringVar(&c.TLSMinVersion, "tls-min-version", c.TLSMinVersion, "Minimum TLS version for HTTPS: 1.2, 1.3 (env: TLS_MIN_VERSION)")
+	flag.BoolVar(&c.EnableH2C, "h2c", c.EnableH2C, "Accept HTTP/2 over cleartext (h2c) alongside HTTP/1.1 (env: ENABLE_H2C)")
+	flag.BoolVar(&c.Metrics, "metrics", c.Metrics, "Expose Prometheus metrics at /metrics (env: METRICS)")
+	flag.StringVar(&c.StaticDir, "static-dir", c.StaticDir, "Directory served at /static/, e.g. static for the test player; empty disables (env: STATIC_DIR)")
+	flag.BoolVar(&c.Debug, "debug", c.Debug, "Enable POST /whep/validate for SDP transform checks (env: DEBUG)")
+	flag.StringVar(&c.PprofAddr, "pprof", c.PprofAddr, "Serve /debug/pprof/ on this separate address, e.g. 127.0.0.1:6060; empty disables (env: PPROF_ADDR)")
 	flag.BoolVar(&c.Verbose, "verbose", c.Verbose, "Enable debug logging (env: VERBOSE)")
+	flag.BoolVar(&c.LogSDPOnFailure, "log-sdp-on-failure", c.LogSDPOnFailure, "Log the client offer, Wowza offer and generated answers when a negotiation fails (env: LOG_SDP_ON_FAILURE)")
 	flag.StringVar(&c.LogFormat, "log-format", c.LogFormat, "Log format: auto, text, json (env: LOG_FORMAT)")
+	flag.StringVar(&c.LogFields, "log-fields", c.LogFields, "Static fields added to every log line, comma-separated key=value (env: LOG_FIELDS)")
+	flag.StringVar(&c.LogRename, "log-rename", c.LogRename, "Rename built-in log keys time, level, msg, source, e.g. msg=message,level=severity (env: LOG_RENAME)")
+	flag.StringVar(&c.AccessLogFormat, "access-log-format", c.AccessLogFormat, "Access log format: slog, combined (env: ACCESS_LOG_FORMAT)")
+	flag.StringVar(&c.AccessLog, "access-log", c.AccessLog, "Combined access log destination: - for stdout, stderr, or a file path (env: ACCESS_LOG)")
+	flag.StringVar(&c.ConfigFile, "config-file", c.ConfigFile, "KEY=VALUE file for settings reloadable on SIGHUP or POST /admin/reload (env: CONFIG_FILE)")
 
 	return c
 }
 
+// RoutePrefix returns BasePath normalised to a leading slash and no trailing
+// slash, or "" when routes are served from the root.
+func (c *Config) RoutePrefix() string {
+	p := strings.Trim(strings.TrimSpace(c.BasePath), "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// publicBaseURL validates PublicBaseURL as an absolute http or https URL and
+// returns it without a trailing slash, or "" when unset.
+func (c *Config) publicBaseURL() (string, error) {
+	raw := strings.TrimSpace(c.PublicBaseURL)
+	if raw == "" {
+		return "", nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid public base URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return "", fmt.Errorf("invalid public base URL %q: want http(s)://host[/path]", raw)
+	}
+	return strings.TrimSuffix(raw, "/"), nil
+}
+
+// validateSDPOrigin checks that SDPSessionName fits on one SDP line and that
+// SDPOriginAddress, when set, is an IP address.
+func (c *Config) validateSDPOrigin() error {
+	if strings.ContainsFunc(c.SDPSessionName, unicode.IsControl) {
+		return fmt.Errorf("invalid SDP session name %q: control characters not allowed", c.SDPSessionName)
+	}
+	if addr := c.SDPOriginAddress; addr != "" && net.ParseIP(addr) == nil {
+		return fmt.Errorf("invalid SDP origin address %q: want an IPv4 or IPv6 address", addr)
+	}
+	return nil
+}
+
+// wowzaProxy parses WowzaProxyURL, returning nil when unset. http proxies are
+// used with CONNECT for both ws and wss; gorilla/websocket can't speak TLS to
+// the proxy itself, so https:// proxy URLs are refused.
+func (c *Config) wowzaProxy() (*url.URL, error) {
+	raw := strings.TrimSpace(c.WowzaProxyURL)
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Wowza proxy URL: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "socks5") || u.Host == "" {
+		return nil, fmt.Errorf("invalid Wowza proxy URL %q: want http://host:port or socks5://host:port", u.Redacted())
+	}
+	return u, nil
+}
+
+// WowzaURLs returns the static mode upstreams in failover order.
+func (c *Config) WowzaURLs() []string {
+	return splitUpstreams(c.WowzaWSURL)
+}
+
+// dialTimeout, offerTimeout and candidateTimeout return the per-phase signaling
+// deadlines, falling back to their WsTimeout-based defaults when unset.
+func (c *Config) dialTimeout() time.Duration  { return c.phaseTimeout(c.DialTimeout, c.WsTimeout/2) }
+func (c *Config) offerTimeout() time.Duration { return c.phaseTimeout(c.OfferTimeout, c.WsTimeout) }
+func (c *Config) candidateTimeout() time.Duration {
+	return c.phaseTimeout(c.CandidateTimeout, c.WsTimeout)
+}
+
+func (c *Config) phaseTimeout(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// ErrNoConfigFile is returned by Reload when ConfigFile is unset.
+var ErrNoConfigFile = errors.New("no config file to reload from")
+
+// ErrInvalidConfigFile wraps Reload errors caused by the file's contents, as
+// opposed to failing to read it.
+var ErrInvalidConfigFile = errors.New("invalid config file")
+
+// reloadable maps the environment names Reload accepts to the fields they
+// replace. Everything else only takes effect on restart.
+func (c *Config) reloadable() map[string]*string {
+	return map[string]*string{
+		"ALLOWED_HOSTS":   &c.AllowedHosts,
+		"ALLOWED_APPS":    &c.AllowedApps,
+		"ALLOWED_STREAMS": &c.AllowedStreams,
+		"ALLOWED_ORIGINS": &c.AllowedOrigins,
+	}
+}
+
+// current reads a field Reload may replace.
+func (c *Config) current(field *string) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return *field
+}
+
+// Reload re-reads ConfigFile and swaps in its values for the reloadable fields,
+// returning the names that changed. Keys the file leaves out keep their current
+// value and other keys are ignored. Nothing changes if the file can't be read
+// or holds a malformed pattern, so a bad edit never leaves a half-applied config.
+func (c *Config) Reload() ([]string, error) {
+	if c.ConfigFile == "" {
+		return nil, ErrNoConfigFile
+	}
+	values, err := readEnvFile(c.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"ALLOWED_HOSTS", "ALLOWED_APPS", "ALLOWED_STREAMS"} {
+		if err := validatePatterns(key, values[key]); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidConfigFile, err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var changed []string
+	for key, field := range c.reloadable() {
+		if v, ok := values[key]; ok && v != *field {
+			*field = v
+			changed = append(changed, key)
+		}
+	}
+	slices.Sort(changed)
+	return changed, nil
+}
+
+// readEnvFile parses a file of KEY=VALUE lines as written for docker --env-file
+// or systemd EnvironmentFile. Blank lines, # comments and an "export " prefix
+// are skipped, and a value may be wrapped in matching quotes.
+func readEnvFile(name string) (map[string]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("open config file: %w", err)
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return nil, fmt.Errorf("%w %s:%d: expected KEY=VALUE", ErrInvalidConfigFile, name, n)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		values[strings.TrimSpace(key)] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read config file: %w", err)
+	}
+	return values, nil
+}
+
+// splitUpstreams splits a comma-separated list of Wowza WebSocket URLs.
+func splitUpstreams(list string) []string {
+	var urls []string
+	for _, u := range strings.Split(list, ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
 // IsHostAllowed checks if a host is in the allowed list.
 // Empty string or "*" means all hosts allowed.
 func (c *Config) IsHostAllowed(host string) bool {
-	allowed := strings.TrimSpace(c.AllowedHosts)
-	if allowed == "" || allowed == "*" {
-		return true
+	return matchList(strings.ToLower(c.current(&c.AllowedHosts)), strings.ToLower(strings.TrimSpace(host)))
+}
+
+// IsAppAllowed checks a Wowza application name against AllowedApps, using the
+// same matcher as IsHostAllowed. Empty string or "*" means all apps allowed.
+func (c *Config) IsAppAllowed(appName string) bool {
+	return matchList(c.current(&c.AllowedApps), appName)
+}
+
+// IsStreamAllowed checks "app/stream" against AllowedStreams. Entries starting
+// with "!" deny and win over allows; a list of only denies allows everything else.
+func (c *Config) IsStreamAllowed(appName, streamName string) bool {
+	return matchList(c.current(&c.AllowedStreams), appName+"/"+streamName)
+}
+
+// ICEServer is a STUN or TURN server advertised to WHEP clients.
+type ICEServer struct {
+	URL        string
+	Username   string
+	Credential string
+}
+
+// ICEServerList parses ICEServers. Credentials in a TURN entry
+// ("turn:user:pass@host:port") are split out of the URL.
+func (c *Config) ICEServerList() []ICEServer {
+	var servers []ICEServer
+	for _, entry := range strings.Split(c.ICEServers, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		srv := ICEServer{URL: entry}
+		scheme, rest, _ := strings.Cut(entry, ":")
+		switch strings.ToLower(scheme) {
+		case "turn", "turns":
+			if at := strings.LastIndex(rest, "@"); at >= 0 {
+				srv.Username, srv.Credential, _ = strings.Cut(rest[:at], ":")
+				srv.URL = scheme + ":" + rest[at+1:]
+			}
+		}
+		servers = append(servers, srv)
 	}
-	host = strings.ToLower(strings.TrimSpace(host))
-	for _, pattern := range strings.Split(allowed, ",") {
-		pattern = strings.ToLower(strings.TrimSpace(pattern))
-		if pattern == "" || pattern == "*" {
-			return true
+	return servers
+}
+
+// CodecPreferenceList parses CodecPreference into path codecs, dropping
+// duplicates and names that aren't supported video codecs.
+func (c *Config) CodecPreferenceList() []string {
+	var codecs []string
+	for _, codec := range strings.Split(c.CodecPreference, ",") {
+		codec = strings.ToLower(strings.TrimSpace(codec))
+		if _, ok := videoCodecNames[codec]; ok && !slices.Contains(codecs, codec) {
+			codecs = append(codecs, codec)
+		}
+	}
+	return codecs
+}
+
+// CORSOrigin returns the Access-Control-Allow-Origin value for a request Origin, and
+// whether credentials may be allowed. A "*" entry allows any origin without credentials;
+// specific origins are echoed back with credentials. Empty means the origin is refused.
+func (c *Config) CORSOrigin(origin string) (allow string, credentials bool) {
+	wildcard := false
+	for _, o := range strings.Split(c.current(&c.AllowedOrigins), ",") {
+		o = strings.TrimSpace(o)
+		if o == "*" {
+			wildcard = true
+			continue
+		}
+		if origin != "" && strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+			return origin, true
+		}
+	}
+	if wildcard {
+		return "*", false
+	}
+	return "", false
+}
+
+// WowzaDialHeader returns the headers sent with the Wowza websocket handshake:
+// a default User-Agent, overridden or extended by WowzaHeaders.
+func (c *Config) WowzaDialHeader() http.Header {
+	h := http.Header{}
+	h.Set("User-Agent", "wowza2whep/"+Version)
+	for _, kv := range parseKeyValues(c.WowzaHeaders) {
+		h.Set(kv[0], kv[1])
+	}
+	return h
+}
+
+// CandidateIPs parses CandidateIPMap into a private to public IP map, keyed by
+// the canonical form of the private IP. Entries that aren't two IPs are skipped.
+func (c *Config) CandidateIPs() map[string]string {
+	ips := make(map[string]string)
+	for _, kv := range parseKeyValues(c.CandidateIPMap) {
+		private, public := net.ParseIP(kv[0]), net.ParseIP(kv[1])
+		if private != nil && public != nil {
+			ips[private.String()] = public.String()
 		}
-		if matchHost(pattern, host) {
+	}
+	return ips
+}
+
+// answerOptions builds the options for answers to a client that asked for
+// codec and media, so negotiation and /whep/validate munge SDP the same way.
+func (c *Config) answerOptions(codec, media string) AnswerOptions {
+	return AnswerOptions{
+		Codec:      codec,
+		FilterIPv6: c.FilterIPv6,
+		Media:      media,
+		DTLSRole:   c.DTLSRole,
+		RelayOnly:  c.RelayOnly,
+
+		KeepWowzaCandidates: c.KeepWowzaCandidates,
+		MaxVideoBitrate:     c.MaxVideoBitrate,
+		ReorderCandidates:   c.ReorderCandidates,
+		RewriteMsid:         c.RewriteMsid,
+
+		CandidateIPs:    c.CandidateIPs(),
+		CodecPreference: c.CodecPreferenceList(),
+
+		SessionName:   c.SDPSessionName,
+		OriginAddress: c.SDPOriginAddress,
+
+		MinPlayoutDelay: c.MinPlayoutDelay,
+		MaxPlayoutDelay: c.MaxPlayoutDelay,
+	}
+}
+
+// parseKeyValues splits a comma-separated "Key=Value" list in order, trimming
+// whitespace and skipping entries without a key.
+func parseKeyValues(list string) [][2]string {
+	var out [][2]string
+	for _, entry := range strings.Split(list, ",") {
+		key, value, ok := strings.Cut(entry, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			continue
+		}
+		out = append(out, [2]string{key, strings.TrimSpace(value)})
+	}
+	return out
+}
+
+// redactHeader returns a copy of h safe for logging, with values of headers
+// whose names suggest credentials replaced.
+func redactHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for name := range out {
+		lower := strings.ToLower(name)
+		for _, hint := range []string{"auth", "key", "token", "secret", "password", "cookie", "signature"} {
+			if strings.Contains(lower, hint) {
+				out[name] = []string{"[redacted]"}
+				break
+			}
+		}
+	}
+	return out
+}
+
+// ClientIP returns the address of the client behind r. X-Forwarded-For is only
+// consulted when the direct peer is a TrustedProxies entry, and is walked from
+// the right so a client can't spoof its address by prepending entries.
+func (c *Config) ClientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	trusted := c.trustedProxies()
+	if len(trusted) == 0 || !isTrustedProxy(ip, trusted) {
+		return ip
+	}
+
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop, trusted) {
+			break
+		}
+	}
+	return ip
+}
+
+func (c *Config) trustedProxies() []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(c.TrustedProxies, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if strings.Contains(entry, ":") {
+				entry += "/128"
+			} else {
+				entry += "/32"
+			}
+		}
+		if _, n, err := net.ParseCIDR(entry); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+func isTrustedProxy(ip string, trusted []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(parsed) {
 			return true
 		}
 	}
 	return false
 }
 
-func matchHost(pattern, host string) bool {
-	if pattern == host {
-		return true
+// UserData collects the ForwardHeaders present in h into Wowza userData. Exact
+// headers are keyed by their lowercase name; prefix matches ("UserData-*") are
+// keyed by the remainder, so "UserData-Geo: DE" becomes "geo": "DE".
+func (c *Config) UserData(h http.Header) map[string]string {
+	var data map[string]string
+	add := func(key, value string) {
+		if data == nil {
+			data = make(map[string]string)
+		}
+		data[strings.ToLower(key)] = sanitizeUserData(value)
 	}
-	// Wildcard match: *.example.com matches foo.example.com and bar.foo.example.com
-	if strings.HasPrefix(pattern, "*.") {
-		suffix := pattern[1:] // .example.com
-		return strings.HasSuffix(host, suffix)
+
+	for _, pattern := range strings.Split(c.ForwardHeaders, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			for name, values := range h {
+				if rest, found := cutPrefixFold(name, prefix); found && rest != "" && len(values) > 0 {
+					add(rest, values[0])
+				}
+			}
+			continue
+		}
+		if v := h.Get(pattern); v != "" {
+			add(pattern, v)
+		}
 	}
-	return false
+	return data
+}
+
+func cutPrefixFold(s, prefix string) (string, bool) {
+	if len(s) < len(prefix) || !strings.EqualFold(s[:len(prefix)], prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// sanitizeUserData strips control characters and caps length so header values
+// can't smuggle anything odd into the Wowza JSON.
+func sanitizeUserData(v string) string {
+	v = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, v)
+	if len(v) > 256 {
+		v = v[:256]
+	}
+	return strings.TrimSpace(v)
+}
+
+// matchList reports whether value passes a comma-separated pattern list.
+// Empty or "*" allows everything; "!pattern" entries deny.
+func matchList(list, value string) bool {
+	allowAll, allowed := true, false
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if deny, ok := strings.CutPrefix(pattern, "!"); ok {
+			if matchPattern(deny, value) {
+				return false
+			}
+			continue
+		}
+		allowAll = false
+		if pattern == "*" || matchPattern(pattern, value) {
+			allowed = true
+		}
+	}
+	return allowAll || allowed
+}
+
+// validateAllowLists checks the glob syntax of the ALLOWED_HOSTS, ALLOWED_APPS
+// and ALLOWED_STREAMS patterns, which would otherwise silently never match.
+func (c *Config) validateAllowLists() error {
+	for key, list := range map[string]string{
+		"ALLOWED_HOSTS":   c.current(&c.AllowedHosts),
+		"ALLOWED_APPS":    c.current(&c.AllowedApps),
+		"ALLOWED_STREAMS": c.current(&c.AllowedStreams),
+	} {
+		if err := validatePatterns(key, list); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validatePatterns reports the first malformed glob in a matchList list.
+func validatePatterns(key, list string) error {
+	for _, pattern := range strings.Split(list, ",") {
+		pattern = strings.TrimPrefix(strings.TrimSpace(pattern), "!")
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid %s pattern %q: %w", key, pattern, err)
+		}
+	}
+	return nil
+}
+
+// matchPattern matches value against a glob where "*" spans anything but "/",
+// so *.example.com matches foo.example.com and bar.foo.example.com, and live/*
+// matches any stream in the live app.
+func matchPattern(pattern, value string) bool {
+	if pattern == value {
+		return true
+	}
+	ok, err := path.Match(pattern, value)
+	return err == nil && ok
 }
 
 func (c *Config) Logger() *slog.Logger {
@@ -88,7 +813,7 @@ func (c *Config) Logger() *slog.Logger {
 		}
 	}
 
-	opts := &slog.HandlerOptions{Level: level}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: c.renameLogKeys()}
 	var handler slog.Handler
 	if format == "json" {
 		handler = slog.NewJSONHandler(os.Stdout, opts)
@@ -96,7 +821,34 @@ func (c *Config) Logger() *slog.Logger {
 		handler = slog.NewTextHandler(os.Stdout, opts)
 	}
 
-	return slog.New(handler)
+	logger := slog.New(handler)
+	for _, kv := range parseKeyValues(c.LogFields) {
+		logger = logger.With(kv[0], kv[1])
+	}
+	return logger
+}
+
+// renameLogKeys returns a ReplaceAttr func applying LogRename to slog's
+// built-in keys (time, level, msg, source), or nil when nothing is renamed.
+func (c *Config) renameLogKeys() func([]string, slog.Attr) slog.Attr {
+	renames := make(map[string]string)
+	for _, kv := range parseKeyValues(c.LogRename) {
+		switch kv[0] {
+		case slog.TimeKey, slog.LevelKey, slog.MessageKey, slog.SourceKey:
+			if kv[1] != "" {
+				renames[kv[0]] = kv[1]
+			}
+		}
+	}
+	if len(renames) == 0 {
+		return nil
+	}
+	return func(groups []string, a slog.Attr) slog.Attr {
+		if to, ok := renames[a.Key]; ok && len(groups) == 0 {
+			a.Key = to
+		}
+		return a
+	}
 }
 
 func env(key, def string) string {
@@ -114,6 +866,24 @@ func envBool(key string, def bool) bool {
 	return def
 }
 
+func envInt(key string, def int) int {
+	if v := os.Getenv(key); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			return n
+		}
+	}
+	return def
+}
+
+func envFloat(key string, def float64) float64 {
+	if v := os.Getenv(key); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return f
+		}
+	}
+	return def
+}
+
 func envDuration(key string, def time.Duration) time.Duration {
 	if v := os.Getenv(key); v != "" {
 		if d, err := time.ParseDuration(v); err == nil {
@@ -122,4 +892,3 @@ func envDuration(key string, def time.Duration) time.Duration {
 	}
 	return def
 }
-
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+// Stable error codes returned in JSON error bodies.
+const (
+	errCodeNotConfigured    = "not_configured"
+	errCodeInvalidConfig    = "invalid_config"
+	errCodeInvalidPath      = "invalid_path"
+	errCodeInvalidCodec     = "invalid_codec"
+	errCodeInvalidHost      = "invalid_host"
+	errCodeHostNotAllowed   = "host_not_allowed"
+	errCodeAppNotAllowed    = "app_not_allowed"
+	errCodeStreamNotAllowed = "stream_not_allowed"
+	errCodeInvalidOffer     = "invalid_offer"
+	errCodeInvalidRequest   = "invalid_request"
+	errCodePayloadTooLarge  = "payload_too_large"
+	errCodeUnsupportedMedia = "unsupported_media_type"
+	errCodeMethodNotAllowed = "method_not_allowed"
+	errCodeSessionLimit     = "session_limit"
+	errCodeRateLimited      = "rate_limited"
+	errCodeNegotiationBusy  = "negotiation_busy"
+	errCodeSignalingFailed  = "signaling_failed"
+	errCodeICERejected      = "candidate_rejected"
+	errCodeStreamNotFound   = "stream_not_found"
+	errCodeStreamForbidden  = "stream_forbidden"
+	errCodeSessionNotFound  = "session_not_found"
+	errCodePrecondition     = "precondition_failed"
+	errCodeUnauthorized     = "unauthorized"
+	errCodeDraining         = "draining"
+	errCodeMaintenance      = "maintenance"
+	errCodeAdminDisabled    = "admin_disabled"
+	errCodeInternal         = "internal_error"
+)
+
+type errorBody struct {
+	Error errorDetail `json:"error"`
+}
+
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// writeSignalingError reports a failed Wowza exchange. Conditions Wowza reported
+// itself are mapped by WowzaError.HTTPStatus; transport failures are a 502 with msg.
+func writeSignalingError(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, ErrNegotiationBusy) {
+		w.Header().Set("Retry-After", "1")
+		writeJSONError(w, http.StatusServiceUnavailable, errCodeNegotiationBusy, "too many concurrent negotiations")
+		return
+	}
+	if errors.Is(err, ErrNoRelayCandidates) {
+		writeJSONError(w, http.StatusBadGateway, errCodeSignalingFailed, ErrNoRelayCandidates.Error())
+		return
+	}
+
+	var wowzaErr *WowzaError
+	if !errors.As(err, &wowzaErr) {
+		writeJSONError(w, http.StatusBadGateway, errCodeSignalingFailed, msg)
+		return
+	}
+
+	switch status := wowzaErr.HTTPStatus(); status {
+	case http.StatusNotFound:
+		writeJSONError(w, status, errCodeStreamNotFound, wowzaErr.Error())
+	case http.StatusUnauthorized:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="whep"`)
+		writeJSONError(w, status, errCodeUnauthorized, wowzaErr.Error())
+	case http.StatusForbidden:
+		writeJSONError(w, status, errCodeStreamForbidden, wowzaErr.Error())
+	default:
+		writeJSONError(w, status, errCodeSignalingFailed, wowzaErr.Error())
+	}
+}
+
+// isUpstreamFailure reports whether a negotiation error leads writeSignalingError
+// to a 502 or 503, as opposed to Wowza rejecting the stream or its token.
+func isUpstreamFailure(err error) bool {
+	var wowzaErr *WowzaError
+	return !errors.As(err, &wowzaErr) || wowzaErr.HTTPStatus() >= http.StatusInternalServerError
+}
+
+// writeJSONError writes {"error":{"code":...,"message":...}} with the given status.
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(errorBody{Error: errorDetail{Code: code, Message: message}})
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// liveConn is a Wowza signaling websocket kept open after Negotiate in
+// KeepWSOpen mode. Its read loop collects late Wowza candidates and trickled
+// client candidates are written to it instead of dialing a new connection.
+type liveConn struct {
+	conn    *websocket.Conn
+	writeMu sync.Mutex // gorilla/websocket allows one concurrent writer
+	stop    func()     // Stops keepalive pings and the Stop hook
+}
+
+// attachConn takes ownership of conn after a successful exchange, replacing
+// any connection kept from an earlier one, and starts its read loop.
+func (s *Session) attachConn(conn *websocket.Conn) {
+	conn.SetPongHandler(nil)
+
+	stopPings := func() {}
+	if interval := s.cfg.WsPingInterval; interval > 0 {
+		stopPings = keepAlive(conn, interval)
+	}
+	stopHook := context.AfterFunc(s.ctx, func() { conn.Close() })
+	lc := &liveConn{conn: conn, stop: func() { stopPings(); stopHook() }}
+
+	s.mu.Lock()
+	prev := s.live
+	s.live = lc
+	s.lateCandidates = nil
+	s.mu.Unlock()
+
+	if prev != nil {
+		prev.conn.Close()
+	}
+	go s.readLoop(lc)
+}
+
+// readLoop collects candidates Wowza sends on lc until the connection closes,
+// the session stops, or nothing arrives for WsIdleTimeout.
+func (s *Session) readLoop(lc *liveConn) {
+	defer s.detachConn(lc)
+
+	for {
+		s.extendIdle(lc)
+		var msg WowzaResponse
+		if err := readWowzaJSON(lc.conn, &msg); err != nil {
+			s.logger.Debug("kept-open Wowza connection closed", "error", err)
+			return
+		}
+
+		if msg.Command != "" && msg.Command != "sendResponse" {
+			s.logger.Debug("ignoring Wowza message", "command", msg.Command, "status", msg.Status)
+			continue
+		}
+		if msg.Status != 0 && (msg.Status < 200 || msg.Status >= 300) {
+			s.logger.Warn("trickle relay rejected by Wowza", "status", msg.Status, "description", msg.StatusDescription)
+			continue
+		}
+		if len(msg.ICECandidates) > 0 {
+			s.logger.Debug("late candidates from Wowza", "ice_candidates", len(msg.ICECandidates))
+			s.mu.Lock()
+			s.lateCandidates = append(s.lateCandidates, msg.ICECandidates...)
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *Session) detachConn(lc *liveConn) {
+	lc.stop()
+	lc.conn.Close()
+
+	s.mu.Lock()
+	if s.live == lc {
+		s.live = nil
+	}
+	s.mu.Unlock()
+}
+
+// extendIdle pushes lc's read deadline to WsIdleTimeout from now, or clears it
+// when the idle timeout is disabled.
+func (s *Session) extendIdle(lc *liveConn) {
+	var deadline time.Time
+	if idle := s.cfg.WsIdleTimeout; idle > 0 {
+		deadline = time.Now().Add(idle)
+	}
+	lc.conn.SetReadDeadline(deadline)
+}
+
+// sendLive writes req on the kept-open connection, reporting false when there
+// is none or the write fails so the caller can fall back to dialing. Client
+// trickle counts as activity for the idle timeout.
+func (s *Session) sendLive(req *WowzaSendResponseRequest) bool {
+	s.mu.Lock()
+	lc := s.live
+	s.mu.Unlock()
+	if lc == nil {
+		return false
+	}
+
+	lc.writeMu.Lock()
+	defer lc.writeMu.Unlock()
+
+	lc.conn.SetWriteDeadline(time.Now().Add(s.cfg.candidateTimeout()))
+	if err := lc.conn.WriteJSON(req); err != nil {
+		s.logger.Warn("relay on kept-open Wowza connection failed, redialing", "error", err)
+		lc.conn.Close()
+		return false
+	}
+	s.extendIdle(lc)
+	return true
+}
+
+// TakeLateCandidates returns the Wowza candidates received on the kept-open
+// connection since the last call, for delivery in a PATCH response.
+func (s *Session) TakeLateCandidates() []WowzaICECandidate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	candidates := s.lateCandidates
+	s.lateCandidates = nil
+	return candidates
+}
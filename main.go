@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
@@ -32,7 +33,14 @@ func main() {
 	)
 
 	if mode == "static" {
-		logger.Info("using static Wowza URL", "url", cfg.WowzaWSURL)
+		logger.Info("using static Wowza URL", "urls", cfg.WowzaURLs())
+	}
+
+	if cfg.ConfigFile != "" {
+		if _, err := cfg.Reload(); err != nil {
+			logger.Error("config file error", "error", err)
+			os.Exit(1)
+		}
 	}
 
 	mgr := NewManager(cfg, logger)
@@ -44,6 +52,10 @@ func main() {
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
+	if cfg.ConfigFile != "" {
+		go watchConfig(ctx, cfg, logger)
+	}
+
 	errCh := make(chan error, 1)
 	go func() { errCh <- srv.Start(ctx) }()
 
@@ -64,3 +76,25 @@ func main() {
 
 	logger.Info("shutdown complete")
 }
+
+// watchConfig reloads ConfigFile on every SIGHUP until ctx is done, alongside
+// the TLS certificate reload. A failed reload keeps the previous values.
+func watchConfig(ctx context.Context, cfg *Config, logger *slog.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			changed, err := cfg.Reload()
+			if err != nil {
+				logger.Error("config reload failed", "error", err)
+				continue
+			}
+			logger.Info("config reloaded", "changed", changed)
+		}
+	}
+}
@@ -2,13 +2,31 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+var (
+	// ErrSessionLimit is returned by Create when MaxSessions is reached.
+	ErrSessionLimit = errors.New("session limit reached")
+	// ErrDraining is returned by Create while the manager is rejecting new sessions.
+	ErrDraining = errors.New("gateway is draining")
+	// ErrMaintenance is returned by Create while maintenance mode is on.
+	ErrMaintenance = errors.New("gateway is in maintenance mode")
+	// ErrNegotiationBusy is returned by Negotiate when no slot under
+	// MaxConcurrentNegotiations frees up in time.
+	ErrNegotiationBusy = errors.New("too many concurrent negotiations")
+)
+
 // Manager handles session lifecycle.
 type Manager struct {
 	cfg    *Config
@@ -16,44 +34,184 @@ type Manager struct {
 
 	mu       sync.RWMutex
 	sessions map[string]*Session
+	limiter  *hostLimiter     // nil when PerHostRate is disabled
+	failures *failureTracker  // nil when RetryAfter is disabled
+	webhook  *webhookNotifier // nil when WebhookURL is unset
+	draining atomic.Bool
+
+	maintenance atomic.Bool // Refuses new sessions like draining, but leaves existing ones alone
+
+	negotiations chan struct{} // Bounds concurrent Wowza exchanges; nil when MaxConcurrentNegotiations is unlimited
+
+	stopReaper chan struct{}
+	reaperDone chan struct{}
+	stopOnce   sync.Once
 }
 
-// NewManager creates a new session manager.
+// NewManager creates a new session manager and starts the idle session reaper.
 func NewManager(cfg *Config, logger *slog.Logger) *Manager {
-	return &Manager{
-		cfg:      cfg,
-		logger:   logger,
-		sessions: make(map[string]*Session),
+	m := &Manager{
+		cfg:        cfg,
+		logger:     logger,
+		sessions:   make(map[string]*Session),
+		stopReaper: make(chan struct{}),
+		reaperDone: make(chan struct{}),
 	}
+	if cfg.PerHostRate > 0 {
+		m.limiter = newHostLimiter(cfg.PerHostRate, cfg.PerHostBurst)
+	}
+	if cfg.RetryAfter > 0 {
+		m.failures = newFailureTracker(cfg.RetryAfter)
+	}
+	if cfg.WebhookURL != "" {
+		m.webhook = newWebhookNotifier(cfg.WebhookURL, logger)
+	}
+	if cfg.MaxConcurrentNegotiations > 0 {
+		m.negotiations = make(chan struct{}, cfg.MaxConcurrentNegotiations)
+	}
+	go m.reapLoop()
+	return m
 }
 
-// Create returns a new signaling session.
-func (m *Manager) Create(appName, streamName, wsURL string) (string, *Session, error) {
+// reapLoop periodically removes sessions that are idle past SessionTTL or never
+// confirmed media within MediaWait.
+func (m *Manager) reapLoop() {
+	defer close(m.reaperDone)
+
+	ttl := m.cfg.SessionTTL
+	wait := m.cfg.MediaWait
+	if ttl <= 0 && wait <= 0 {
+		return
+	}
+
+	interval := ttl / 4
+	if wait > 0 && (interval <= 0 || wait/4 < interval) {
+		interval = wait / 4
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.reapExpired(ttl)
+		case <-m.stopReaper:
+			return
+		}
+	}
+}
+
+func (m *Manager) reapExpired(ttl time.Duration) {
+	now := time.Now()
+
+	m.mu.RLock()
+	var expired []string
+	for id, sess := range m.sessions {
+		if sess.Expired(now, ttl) {
+			expired = append(expired, id)
+		}
+	}
+	m.mu.RUnlock()
+
+	for _, id := range expired {
+		m.logger.Info("reaping expired session", "session_id", id)
+		m.Remove(id)
+	}
+}
+
+// Create returns a new signaling session. The session's logger carries the
+// request ID from ctx so its negotiation logs correlate with the HTTP request.
+func (m *Manager) Create(ctx context.Context, appName, streamName, codec, wsURL, clientIP string) (string, *Session, error) {
+	if m.draining.Load() {
+		return "", nil, ErrDraining
+	}
+	if m.maintenance.Load() {
+		return "", nil, ErrMaintenance
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
+	if limit := m.cfg.MaxSessions; limit > 0 && len(m.sessions) >= limit {
+		return "", nil, fmt.Errorf("%w: %d active, limit %d", ErrSessionLimit, len(m.sessions), limit)
+	}
+
+	if m.limiter != nil {
+		host := upstreamHost(wsURL)
+		if ok, wait := m.limiter.Allow(host); !ok {
+			return "", nil, &RateLimitError{Host: host, RetryAfter: wait}
+		}
+	}
+
 	id := "session-" + uuid.New().String()
-	sess := NewSession(id, appName, streamName, wsURL, m.cfg, m.logger)
+	logger := withRequestID(ctx, m.logger)
+	sess := NewSession(id, appName, streamName, codec, wsURL, m.cfg, logger)
+	sess.clientIP = clientIP
+	sess.negotiations = m.negotiations
 	sess.SetStopCallback(m.onSessionStopped)
 	m.sessions[id] = sess
+	metricSessionsCreated.Inc()
+	metricActiveSessions.Set(float64(len(m.sessions)))
 
-	m.logger.Info("session created",
+	logger.Info("session created",
 		"session_id", id,
 		"app", appName,
 		"stream", streamName,
+		"codec", codec,
+		"client_ip", clientIP,
 		"active", len(m.sessions),
 	)
 
+	if m.webhook != nil {
+		m.webhook.Notify(eventSessionCreated, sess)
+	}
+
 	return id, sess, nil
 }
 
-func (m *Manager) onSessionStopped(id string) {
+// upstreamHost returns the Wowza host that rate limits and failure counts are
+// kept under. Static mode failover lists count against their primary upstream.
+func upstreamHost(wsURL string) string {
+	primary, _, _ := strings.Cut(wsURL, ",")
+	if u, err := url.Parse(primary); err == nil {
+		return u.Host
+	}
+	return primary
+}
+
+// SignalingFailed records a failed negotiation against wsURL's host and returns
+// how long the client should wait before retrying, or 0 when RetryAfter is disabled.
+func (m *Manager) SignalingFailed(wsURL string) time.Duration {
+	if m.failures == nil {
+		return 0
+	}
+	return m.failures.Fail(upstreamHost(wsURL))
+}
+
+// SignalingSucceeded resets the failure count for wsURL's host.
+func (m *Manager) SignalingSucceeded(wsURL string) {
+	if m.failures != nil {
+		m.failures.Succeed(upstreamHost(wsURL))
+	}
+}
+
+func (m *Manager) onSessionStopped(sess *Session) {
+	id := sess.ID()
+
 	m.mu.Lock()
 	delete(m.sessions, id)
 	count := len(m.sessions)
 	m.mu.Unlock()
+	metricActiveSessions.Set(float64(count))
 
 	m.logger.Info("session removed", "session_id", id, "active", count)
+
+	if m.webhook != nil {
+		m.webhook.Notify(eventSessionStopped, sess)
+	}
 }
 
 // Get retrieves a session by ID.
@@ -64,12 +222,14 @@ func (m *Manager) Get(id string) (*Session, bool) {
 	return sess, ok
 }
 
-// Remove stops and removes a session.
+// Remove stops and removes a session. Unknown or already-removed IDs are a
+// no-op, and Stop runs the stop callback at most once.
 func (m *Manager) Remove(id string) {
 	m.mu.Lock()
 	sess, ok := m.sessions[id]
 	if ok {
 		delete(m.sessions, id)
+		metricActiveSessions.Set(float64(len(m.sessions)))
 	}
 	m.mu.Unlock()
 
@@ -78,6 +238,42 @@ func (m *Manager) Remove(id string) {
 	}
 }
 
+// DrainAll stops every active session and returns how many were stopped.
+// When reject is true, Create fails with ErrDraining until Undrain is called.
+func (m *Manager) DrainAll(reject bool) int {
+	if reject {
+		m.draining.Store(true)
+	}
+
+	ids := m.ActiveIDs()
+	for _, id := range ids {
+		m.Remove(id)
+	}
+
+	m.logger.Info("drained sessions", "count", len(ids), "rejecting", m.draining.Load())
+	return len(ids)
+}
+
+// Undrain resumes accepting new sessions after DrainAll.
+func (m *Manager) Undrain() {
+	m.draining.Store(false)
+	m.logger.Info("accepting new sessions")
+}
+
+// Draining reports whether new sessions are being rejected.
+func (m *Manager) Draining() bool { return m.draining.Load() }
+
+// SetMaintenance turns maintenance mode on or off. While on, Create fails with
+// ErrMaintenance and existing sessions carry on.
+func (m *Manager) SetMaintenance(on bool) {
+	if m.maintenance.Swap(on) != on {
+		m.logger.Info("maintenance mode changed", "maintenance", on, "active", len(m.ActiveIDs()))
+	}
+}
+
+// Maintenance reports whether maintenance mode is on.
+func (m *Manager) Maintenance() bool { return m.maintenance.Load() }
+
 // ActiveIDs returns all active session IDs.
 func (m *Manager) ActiveIDs() []string {
 	m.mu.RLock()
@@ -89,16 +285,54 @@ func (m *Manager) ActiveIDs() []string {
 	return out
 }
 
-// Stats returns statistics for all sessions.
-func (m *Manager) Stats() map[string]any {
+// StatsFilter selects the sessions Stats reports. Empty App and Stream match
+// everything; Limit <= 0 returns every match after Offset.
+type StatsFilter struct {
+	App    string
+	Stream string
+	Offset int
+	Limit  int
+}
+
+func (f StatsFilter) matches(sess *Session) bool {
+	return (f.App == "" || sess.appName == f.App) && (f.Stream == "" || sess.streamName == f.Stream)
+}
+
+// Stats returns statistics for the sessions matching f, oldest first so pages
+// stay stable while sessions come and go. Only the requested page is
+// serialized; "total" counts every match.
+func (m *Manager) Stats(f StatsFilter) map[string]any {
 	m.mu.RLock()
-	defer m.mu.RUnlock()
-	sessions := make([]map[string]any, 0, len(m.sessions))
+	active := len(m.sessions)
+	var matched []*Session
 	for _, sess := range m.sessions {
+		if f.matches(sess) {
+			matched = append(matched, sess)
+		}
+	}
+	m.mu.RUnlock()
+
+	slices.SortFunc(matched, func(a, b *Session) int {
+		if c := a.createdAt.Compare(b.createdAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.id, b.id)
+	})
+
+	total := len(matched)
+	page := matched[min(f.Offset, total):]
+	if f.Limit > 0 && f.Limit < len(page) {
+		page = page[:f.Limit]
+	}
+
+	sessions := make([]map[string]any, 0, len(page))
+	for _, sess := range page {
 		sessions = append(sessions, sess.Stats())
 	}
 	return map[string]any{
-		"active_sessions": len(m.sessions),
+		"active_sessions": active,
+		"total":           total,
+		"offset":          f.Offset,
 		"timestamp":       time.Now().Unix(),
 		"sessions":        sessions,
 	}
@@ -106,6 +340,9 @@ func (m *Manager) Stats() map[string]any {
 
 // Shutdown gracefully stops all sessions.
 func (m *Manager) Shutdown(ctx context.Context) error {
+	m.stopOnce.Do(func() { close(m.stopReaper) })
+	<-m.reaperDone
+
 	m.mu.Lock()
 	snapshot := make([]*Session, 0, len(m.sessions))
 	for _, s := range m.sessions {
@@ -113,19 +350,20 @@ func (m *Manager) Shutdown(ctx context.Context) error {
 	}
 	m.sessions = make(map[string]*Session)
 	m.mu.Unlock()
+	metricActiveSessions.Set(0)
 
-	if len(snapshot) == 0 {
-		return nil
+	if len(snapshot) > 0 {
+		m.logger.Info("shutting down sessions", "count", len(snapshot))
 	}
 
-	m.logger.Info("shutting down sessions", "count", len(snapshot))
-
 	var wg sync.WaitGroup
+	var stopped atomic.Int32
 	for _, s := range snapshot {
 		wg.Add(1)
 		go func(sess *Session) {
 			defer wg.Done()
 			sess.Stop()
+			stopped.Add(1)
 		}(s)
 	}
 
@@ -137,8 +375,17 @@ func (m *Manager) Shutdown(ctx context.Context) error {
 
 	select {
 	case <-done:
-		return nil
 	case <-ctx.Done():
+		m.logger.Warn("shutdown deadline reached, dropping sessions",
+			"dropped", len(snapshot)-int(stopped.Load()),
+			"total", len(snapshot),
+		)
 		return ctx.Err()
 	}
+
+	// Flush stop events queued by the sessions above
+	if m.webhook != nil {
+		return m.webhook.Close(ctx)
+	}
+	return nil
 }
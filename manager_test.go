@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testLogger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestManagerCreateSessionLimit(t *testing.T) {
+	const limit = 8
+	m := NewManager(&Config{MaxSessions: limit}, testLogger())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := m.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	})
+
+	// Create never dials, so the upstream only has to parse
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	errs := make([]error, limit+1)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			_, _, errs[i] = m.Create(context.Background(), "live", "stream", "h264", "ws://127.0.0.1:1/webrtc-session.json", "192.0.2.1")
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	var limited int
+	for _, err := range errs {
+		switch {
+		case err == nil:
+		case errors.Is(err, ErrSessionLimit):
+			limited++
+		default:
+			t.Errorf("Create: unexpected error %v", err)
+		}
+	}
+	if limited != 1 {
+		t.Errorf("got %d ErrSessionLimit, want 1", limited)
+	}
+	if got := len(m.ActiveIDs()); got != limit {
+		t.Errorf("got %d active sessions, want %d", got, limit)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricActiveSessions = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "wowza2whep",
+		Name:      "active_sessions",
+		Help:      "Number of sessions currently tracked.",
+	})
+
+	metricSessionsCreated = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "wowza2whep",
+		Name:      "sessions_created_total",
+		Help:      "Total sessions created.",
+	})
+
+	metricSignalingFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wowza2whep",
+		Name:      "signaling_failures_total",
+		Help:      "Signaling failures by stage.",
+	}, []string{"stage"})
+
+	metricWebhookDropped = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "wowza2whep",
+		Name:      "webhook_dropped_total",
+		Help:      "Webhook events dropped because the delivery queue was full.",
+	})
+
+	metricResponseBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "wowza2whep",
+		Name:      "http_response_bytes_total",
+		Help:      "Response body bytes written to HTTP clients.",
+	})
+
+	metricWowzaCandidates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "wowza2whep",
+		Name:      "wowza_candidates_total",
+		Help:      "ICE candidates returned by Wowza during negotiation, by transport and type.",
+	}, []string{"transport", "type"})
+
+	metricNegotiateDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "wowza2whep",
+		Name:      "negotiate_duration_seconds",
+		Help:      "Duration of successful Wowza signaling exchanges.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 10),
+	})
+)
+
+// Signaling failure stages for metricSignalingFailures.
+const (
+	stageDial         = "dial"
+	stageGetOffer     = "getOffer"
+	stageSendResponse = "sendResponse"
+	stageAnswer       = "answer"
+)
+
+func signalingFailed(stage string) {
+	metricSignalingFailures.WithLabelValues(stage).Inc()
+}
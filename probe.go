@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	probeTimeout  = 3 * time.Second
+	probeCacheTTL = 5 * time.Second
+)
+
+// wowzaProbe checks that a static Wowza upstream accepts a websocket handshake.
+// Results are cached briefly so frequent load balancer probes don't each dial Wowza.
+type wowzaProbe struct {
+	cfg *Config
+
+	mu        sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+func newWowzaProbe(cfg *Config) *wowzaProbe {
+	return &wowzaProbe{cfg: cfg}
+}
+
+// Check returns the cached result, dialing Wowza again once it is older than
+// probeCacheTTL. Concurrent callers wait for a single probe. With several
+// upstreams the gateway is healthy while any of them accepts a handshake.
+func (p *wowzaProbe) Check(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.checkedAt.IsZero() && time.Since(p.checkedAt) < probeCacheTTL {
+		return p.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	var err error
+	for _, wsURL := range p.cfg.WowzaURLs() {
+		var conn *websocket.Conn
+		if conn, _, err = dialWowza(ctx, p.cfg, wsURL, probeTimeout); err == nil {
+			conn.Close()
+			break
+		}
+	}
+	p.checkedAt = time.Now()
+	p.err = err
+	return err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// RateLimitError is returned by Manager.Create when a host exceeds PerHostRate.
+type RateLimitError struct {
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limit exceeded for host %s, retry after %s", e.Host, e.RetryAfter)
+}
+
+// hostLimiter is a token bucket per Wowza host. Buckets that have refilled
+// completely are indistinguishable from new ones, so they are swept to keep
+// the map from growing with every unique host.
+type hostLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newHostLimiter(rate float64, burst int) *hostLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &hostLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Allow takes a token for host. When none is available it reports how long
+// until one will be.
+func (l *hostLimiter) Allow(host string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	b, ok := l.buckets[host]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[host] = b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops buckets that have had time to refill, at most once per refill period.
+func (l *hostLimiter) sweep(now time.Time) {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.lastSweep) < refill {
+		return
+	}
+	l.lastSweep = now
+
+	for host, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, host)
+		}
+	}
+}
+
+// failureWindow is how long a host's signaling failures keep counting toward
+// a longer Retry-After, and maxRetryAfter caps the computed value.
+const (
+	failureWindow = time.Minute
+	maxRetryAfter = time.Minute
+)
+
+// failureTracker counts recent signaling failures per Wowza host so clients
+// retrying an overloaded Wowza are told to back off for longer each time.
+type failureTracker struct {
+	base time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostFailures
+}
+
+type hostFailures struct {
+	count int
+	first time.Time
+}
+
+func newFailureTracker(base time.Duration) *failureTracker {
+	return &failureTracker{base: base, hosts: make(map[string]*hostFailures)}
+}
+
+// Fail records a failure for host and returns the Retry-After to send: base
+// doubled for each earlier failure within failureWindow, capped at
+// maxRetryAfter, plus up to a quarter of that as jitter so clients spread out.
+func (t *failureTracker) Fail(host string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for h, f := range t.hosts {
+		if now.Sub(f.first) > failureWindow {
+			delete(t.hosts, h)
+		}
+	}
+
+	f, ok := t.hosts[host]
+	if !ok {
+		f = &hostFailures{first: now}
+		t.hosts[host] = f
+	}
+	f.count++
+
+	wait := t.base << min(f.count-1, 10)
+	if wait <= 0 || wait > maxRetryAfter {
+		wait = maxRetryAfter
+	}
+	return wait + rand.N(wait/4+1)
+}
+
+// Succeed clears host's failures after a successful negotiation.
+func (t *failureTracker) Succeed(host string) {
+	t.mu.Lock()
+	delete(t.hosts, host)
+	t.mu.Unlock()
+}
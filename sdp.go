@@ -1,9 +1,13 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/pion/sdp/v3"
 )
@@ -17,10 +21,99 @@ type ICECredentials struct {
 	Candidates  []string
 }
 
+// AnswerOptions controls how answers are built from Wowza's offer.
+type AnswerOptions struct {
+	Codec      string // Requested video codec, or "any" for Wowza's preferred one; empty keeps all
+	FilterIPv6 bool   // Drop every IPv6 client candidate, not just link-local and ULA
+	Media      string // "audio" or "video" to disable the other type; empty keeps both
+	DTLSRole   string // Wowza's DTLS role toward the client: "passive", "active" or "auto"
+	RelayOnly  bool   // Keep only Wowza's relay candidates in the client answer
+
+	KeepWowzaCandidates bool // Leave Wowza's own candidates in the answer for Wowza
+	MaxVideoBitrate     int  // Cap in kbps written as b=AS on the video section; <= 0 leaves Wowza's
+	ReorderCandidates   bool // Sort Wowza's candidates UDP host > srflx > relay > TCP and rewrite priorities to match
+	RewriteMsid         bool // Replace Wowza's msid with "stream-<mid> track-<mid>" in the client answer
+
+	CandidateIPs    map[string]string // Private to public IPs rewritten in Wowza's candidates
+	CodecPreference []string          // Video codecs "any" tries in order; Wowza's first choice when none match
+
+	SessionName   string // s= line of the client answer; empty writes "-"
+	OriginAddress string // o= unicast address of the client answer, IPv4 or IPv6; empty writes 127.0.0.1
+
+	// Bounds for a playout-delay extmap added under the client's ID when the
+	// client offers the extension and Wowza doesn't; both zero adds nothing
+	MinPlayoutDelay time.Duration
+	MaxPlayoutDelay time.Duration
+}
+
+// ErrNoRelayCandidates is returned by CreateAnswerForClient when RelayOnly is set
+// and Wowza offered no relay candidates, since the answer could never connect.
+var ErrNoRelayCandidates = errors.New("wowza offered no relay candidates")
+
+// clientSetup returns the a=setup value for the client answer. "auto" answers
+// whatever the client offered: passive for actpass or active, active for passive.
+// Anything unrecognised falls back to passive.
+func (o AnswerOptions) clientSetup(offered string) string {
+	switch strings.ToLower(o.DTLSRole) {
+	case "active":
+		return "active"
+	case "auto":
+		if strings.EqualFold(strings.TrimSpace(offered), "passive") {
+			return "active"
+		}
+	}
+	return "passive"
+}
+
+// wowzaSetup returns the a=setup value for Wowza's answer, the complement of
+// the client-facing role so both ends agree on who starts the handshake.
+func (o AnswerOptions) wowzaSetup(offered string) string {
+	if o.clientSetup(offered) == "active" {
+		return "passive"
+	}
+	return "active"
+}
+
+// wantsMedia reports whether mediaType should be negotiated under opts.Media.
+func (o AnswerOptions) wantsMedia(mediaType string) bool {
+	return o.Media == "" || strings.EqualFold(o.Media, mediaType)
+}
+
 // MediaInfo holds information about a media section
 type MediaInfo struct {
-	Mid  string
-	Type string // "video" or "audio"
+	Mid    string
+	Type   string   // "video" or "audio"
+	Codecs []string // Lowercase encoding names from rtpmap lines, e.g. "opus"
+	Extmap []string // RTP header extension URIs from extmap lines
+	Rsize  bool     // Offered a=rtcp-rsize
+
+	PlayoutDelayID string // extmap ID the client gave playout-delay; empty if not offered
+
+	Fingerprint string // This section's own a=fingerprint, if any
+
+	ZeroPort   bool // Offered with port 0
+	BundleOnly bool // Offered a=bundle-only: port 0, but sharing the BUNDLE transport
+
+	Direction string // sendrecv, sendonly, recvonly or inactive; empty means sendrecv
+
+	RecvRids []string // rids the client offered to receive via a=simulcast:recv
+}
+
+// disabled reports whether the client rejected the section itself. A port-0
+// section is only live when it's bundle-only; otherwise RFC 3264 requires the
+// answer to reject it too.
+func (m MediaInfo) disabled() bool {
+	return m.ZeroPort && !m.BundleOnly
+}
+
+// answerDirection returns our direction for a client section: sendonly when
+// the client will receive, inactive otherwise.
+func (m MediaInfo) answerDirection() string {
+	switch m.Direction {
+	case "", "sendrecv", "recvonly":
+		return "sendonly"
+	}
+	return "inactive"
 }
 
 // splitSDPLines splits SDP by CRLF or LF
@@ -32,6 +125,66 @@ func splitSDPLines(sdp string) []string {
 	return lines
 }
 
+// ErrMissingMid is returned by EnsureMids when a client media section has no
+// a=mid, which would leave an empty BUNDLE group in the answer.
+var ErrMissingMid = errors.New("every media section in the offer needs an a=mid")
+
+// EnsureMids checks that every media section in offer has a non-empty a=mid.
+// With synthesize, missing mids are filled in with the section index (or the
+// next number not already in use) ahead of the section's attributes and the
+// rewritten offer is returned; otherwise ErrMissingMid is.
+func EnsureMids(offer string, synthesize bool) (string, error) {
+	media := ExtractMediaOrder(offer)
+	used := make(map[string]bool)
+	missing := false
+	for _, m := range media {
+		if m.Mid == "" {
+			missing = true
+		}
+		used[m.Mid] = true
+	}
+	if !missing {
+		return offer, nil
+	}
+	if !synthesize {
+		return "", ErrMissingMid
+	}
+
+	next := 0
+	newMid := func(index int) string {
+		if mid := strconv.Itoa(index); !used[mid] {
+			used[mid] = true
+			return mid
+		}
+		for used[strconv.Itoa(next)] {
+			next++
+		}
+		used[strconv.Itoa(next)] = true
+		return strconv.Itoa(next)
+	}
+
+	var out []string
+	section, pending := -1, false
+	for _, line := range splitSDPLines(offer) {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "m=") {
+			if pending {
+				out = append(out, "a=mid:"+newMid(section))
+			}
+			section++
+			pending = section < len(media) && media[section].Mid == ""
+		} else if pending && (strings.HasPrefix(trimmed, "a=") || trimmed == "") {
+			out = append(out, "a=mid:"+newMid(section))
+			pending = false
+		}
+		out = append(out, line)
+	}
+	if pending {
+		out = append(out, "a=mid:"+newMid(section), "")
+	}
+	return strings.Join(out, "\r\n"), nil
+}
+
 // ExtractCredentials extracts ICE/DTLS credentials from an SDP
 func ExtractCredentials(sdpStr string) (*ICECredentials, error) {
 	creds := &ICECredentials{}
@@ -55,6 +208,39 @@ func ExtractCredentials(sdpStr string) (*ICECredentials, error) {
 	return creds, nil
 }
 
+// sessionFingerprint returns the session-level a=fingerprint of sdpStr, or ""
+// when fingerprints only appear in media sections.
+func sessionFingerprint(sdpStr string) string {
+	for _, line := range splitSDPLines(sdpStr) {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "m=") {
+			break
+		}
+		if fp, ok := strings.CutPrefix(line, "a=fingerprint:"); ok {
+			return fp
+		}
+	}
+	return ""
+}
+
+// mediaFingerprint picks the client fingerprint for the Wowza section at index
+// with mediaType: that of the first client section of the same type, else the
+// client section at the same index, else fallback.
+func mediaFingerprint(clientMedia []MediaInfo, mediaType string, index int, fallback string) string {
+	for _, m := range clientMedia {
+		if strings.EqualFold(m.Type, mediaType) {
+			if m.Fingerprint != "" {
+				return m.Fingerprint
+			}
+			break
+		}
+	}
+	if index < len(clientMedia) && clientMedia[index].Fingerprint != "" {
+		return clientMedia[index].Fingerprint
+	}
+	return fallback
+}
+
 // ExtractMediaOrder extracts the order and mid values of media sections from an SDP
 func ExtractMediaOrder(sdpStr string) []MediaInfo {
 	var result []MediaInfo
@@ -68,10 +254,34 @@ func ExtractMediaOrder(sdpStr string) []MediaInfo {
 			}
 			parts := strings.Fields(line)
 			if len(parts) >= 4 {
-				current = &MediaInfo{Type: parts[0][2:]}
+				current = &MediaInfo{Type: parts[0][2:], ZeroPort: parts[1] == "0"}
+			}
+		} else if current != nil && strings.HasPrefix(line, "a=fingerprint:") {
+			if current.Fingerprint == "" {
+				current.Fingerprint = strings.TrimPrefix(line, "a=fingerprint:")
 			}
+		} else if current != nil && line == "a=bundle-only" {
+			current.BundleOnly = true
 		} else if current != nil && strings.HasPrefix(line, "a=mid:") {
 			current.Mid = strings.TrimPrefix(line, "a=mid:")
+		} else if current != nil && strings.HasPrefix(line, "a=rtpmap:") {
+			if _, codec, ok := parseRtpmap(strings.TrimPrefix(line, "a=rtpmap:")); ok {
+				current.Codecs = append(current.Codecs, codec)
+			}
+		} else if current != nil && line == "a=rtcp-rsize" {
+			current.Rsize = true
+		} else if current != nil && (line == "a=sendrecv" || line == "a=sendonly" || line == "a=recvonly" || line == "a=inactive") {
+			current.Direction = strings.TrimPrefix(line, "a=")
+		} else if current != nil && strings.HasPrefix(line, "a=simulcast:") {
+			current.RecvRids = parseSimulcastRecv(strings.TrimPrefix(line, "a=simulcast:"))
+		} else if current != nil && strings.HasPrefix(line, "a=extmap:") {
+			value := strings.TrimPrefix(line, "a=extmap:")
+			if uri, ok := parseExtmap(value); ok {
+				current.Extmap = append(current.Extmap, uri)
+				if uri == playoutDelayURI {
+					current.PlayoutDelayID = extmapID(value)
+				}
+			}
 		}
 	}
 	if current != nil {
@@ -81,9 +291,496 @@ func ExtractMediaOrder(sdpStr string) []MediaInfo {
 	return result
 }
 
+// parseRtpmap parses an rtpmap value like "111 opus/48000/2" into its payload
+// type and lowercase encoding name.
+func parseRtpmap(value string) (pt, codec string, ok bool) {
+	pt, rest, found := strings.Cut(strings.TrimSpace(value), " ")
+	if !found || pt == "" {
+		return "", "", false
+	}
+	codec, _, _ = strings.Cut(strings.TrimSpace(rest), "/")
+	if codec == "" {
+		return "", "", false
+	}
+	return pt, strings.ToLower(codec), true
+}
+
+// parseExtmap returns the extension URI from an extmap value like
+// "3/recvonly http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time".
+func parseExtmap(value string) (uri string, ok bool) {
+	fields := strings.Fields(value)
+	if len(fields) < 2 {
+		return "", false
+	}
+	return fields[1], true
+}
+
+// extmapID returns the numeric ID of an extmap value, without any direction.
+func extmapID(value string) string {
+	id, _, _ := strings.Cut(strings.TrimSpace(value), " ")
+	id, _, _ = strings.Cut(id, "/")
+	return id
+}
+
+// playoutDelayURI is the header extension Chrome reads its jitter buffer
+// bounds from.
+const playoutDelayURI = "http://www.webrtc.org/experiments/rtp-hdrext/playout-delay"
+
+// maxPlayoutDelay is the largest bound the extension's 12-bit fields carry,
+// in its 10 ms units.
+const maxPlayoutDelay = 4095 * 10 * time.Millisecond
+
+// playoutDelay returns the configured playout-delay bounds clamped to what the
+// extension can carry, rounded down to 10 ms, with max raised to at least min.
+// ok is false when neither bound is set.
+func (o AnswerOptions) playoutDelay() (minDelay, maxDelay time.Duration, ok bool) {
+	if o.MinPlayoutDelay <= 0 && o.MaxPlayoutDelay <= 0 {
+		return 0, 0, false
+	}
+	clamp := func(d time.Duration) time.Duration {
+		return min(max(d, 0), maxPlayoutDelay).Truncate(10 * time.Millisecond)
+	}
+	minDelay, maxDelay = clamp(o.MinPlayoutDelay), clamp(o.MaxPlayoutDelay)
+	return minDelay, max(minDelay, maxDelay), true
+}
+
+// playoutDelayExtmap returns the extmap to add to a client answer section
+// whose Wowza counterpart doesn't offer playout-delay, or false when the client
+// didn't offer it, no bounds are configured, or its ID is taken by an extmap
+// already in attrs. The bounds travel as extension attributes, in milliseconds.
+func playoutDelayExtmap(client MediaInfo, attrs []sdp.Attribute, opts AnswerOptions) (sdp.Attribute, bool) {
+	minDelay, maxDelay, ok := opts.playoutDelay()
+	if !ok || client.PlayoutDelayID == "" {
+		return sdp.Attribute{}, false
+	}
+	for _, attr := range attrs {
+		if attr.Key != "extmap" {
+			continue
+		}
+		if uri, _ := parseExtmap(attr.Value); uri == playoutDelayURI || extmapID(attr.Value) == client.PlayoutDelayID {
+			return sdp.Attribute{}, false
+		}
+	}
+	return sdp.Attribute{
+		Key: "extmap",
+		Value: fmt.Sprintf("%s %s min=%d;max=%d", client.PlayoutDelayID, playoutDelayURI,
+			minDelay.Milliseconds(), maxDelay.Milliseconds()),
+	}, true
+}
+
+// rewriteMsid replaces the stream and track IDs in an a=msid or a=ssrc attribute
+// with ones derived from mid, so the browser maps each section to exactly one
+// track. The legacy ssrc mslabel and label lines are rewritten to match; other
+// attributes are returned unchanged.
+func rewriteMsid(attr sdp.Attribute, mid string) sdp.Attribute {
+	stream, track := "stream-"+mid, "track-"+mid
+	if attr.Key == "msid" {
+		attr.Value = stream + " " + track
+		return attr
+	}
+	if attr.Key != "ssrc" {
+		return attr
+	}
+
+	ssrc, rest, _ := strings.Cut(attr.Value, " ")
+	name, _, _ := strings.Cut(rest, ":")
+	switch name {
+	case "msid":
+		attr.Value = ssrc + " msid:" + stream + " " + track
+	case "mslabel":
+		attr.Value = ssrc + " mslabel:" + stream
+	case "label":
+		attr.Value = ssrc + " label:" + track
+	}
+	return attr
+}
+
+// parseSimulcastRecv returns the rids in the recv part of a simulcast value like
+// "recv h;m;~l", in order and without pause markers. Alternatives ("h,m") count
+// as separate rids.
+func parseSimulcastRecv(value string) []string {
+	fields := strings.Fields(value)
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i] != "recv" {
+			continue
+		}
+		var rids []string
+		for _, r := range strings.FieldsFunc(fields[i+1], func(c rune) bool { return c == ';' || c == ',' }) {
+			rids = append(rids, strings.TrimPrefix(r, "~"))
+		}
+		return rids
+	}
+	return nil
+}
+
+// simulcastAttrs builds the answer's a=rid and a=simulcast lines for layers the
+// client asked to receive and Wowza offers to send, matched by rid. Wowza's rid
+// lines are kept intact since their restrictions describe what it will send.
+// Without a common rid the section stays single-layer.
+func simulcastAttrs(client MediaInfo, wowzaMD *sdp.MediaDescription) []sdp.Attribute {
+	if len(client.RecvRids) == 0 {
+		return nil
+	}
+
+	wowzaRids := make(map[string]sdp.Attribute)
+	for _, attr := range wowzaMD.Attributes {
+		if attr.Key != "rid" {
+			continue
+		}
+		fields := strings.Fields(attr.Value)
+		if len(fields) >= 2 && fields[1] == "send" {
+			wowzaRids[fields[0]] = attr
+		}
+	}
+
+	var attrs []sdp.Attribute
+	var common []string
+	for _, rid := range client.RecvRids {
+		if attr, ok := wowzaRids[rid]; ok && !slices.Contains(common, rid) {
+			attrs = append(attrs, attr)
+			common = append(common, rid)
+		}
+	}
+	if len(common) == 0 {
+		return nil
+	}
+	return append(attrs, sdp.Attribute{Key: "simulcast", Value: "send " + strings.Join(common, ";")})
+}
+
+// intersectCodecs returns the encoding names Wowza offers in wowzaMD that the
+// client also offered. A client section without rtpmap lines is treated as
+// accepting everything, since we have nothing to compare against.
+func intersectCodecs(client MediaInfo, wowzaMD *sdp.MediaDescription) []string {
+	var common []string
+	for _, attr := range wowzaMD.Attributes {
+		if attr.Key != "rtpmap" {
+			continue
+		}
+		_, codec, ok := parseRtpmap(attr.Value)
+		if !ok {
+			continue
+		}
+		if len(client.Codecs) == 0 || slices.Contains(client.Codecs, codec) {
+			common = append(common, codec)
+		}
+	}
+	return common
+}
+
+// videoCodecNames maps a path codec to the rtpmap encoding names that satisfy it.
+var videoCodecNames = map[string][]string{
+	"h264": {"h264"},
+	"vp8":  {"vp8"},
+	"vp9":  {"vp9"},
+	"h265": {"h265", "hevc"},
+}
+
+// codecAny is the path codec that accepts whichever video codec Wowza prefers.
+const codecAny = "any"
+
+// IsSupportedCodec reports whether codec is a valid video codec path segment.
+func IsSupportedCodec(codec string) bool {
+	_, ok := videoCodecNames[codec]
+	return ok || codec == codecAny
+}
+
+// SupportedCodecs returns the video codec path segments in sorted order.
+func SupportedCodecs() []string {
+	codecs := make([]string, 0, len(videoCodecNames)+1)
+	for codec := range videoCodecNames {
+		codecs = append(codecs, codec)
+	}
+	codecs = append(codecs, codecAny)
+	slices.Sort(codecs)
+	return codecs
+}
+
+// detectVideoCodec returns the path codec of the first format on md's m-line
+// that maps to a supported codec, skipping rtx, red and ulpfec. The m-line
+// lists formats in Wowza's preference order.
+func detectVideoCodec(md *sdp.MediaDescription) (string, bool) {
+	names := make(map[string]string)
+	for _, attr := range md.Attributes {
+		if attr.Key != "rtpmap" {
+			continue
+		}
+		if pt, name, ok := parseRtpmap(attr.Value); ok {
+			names[pt] = name
+		}
+	}
+	for _, f := range md.MediaName.Formats {
+		for codec, aliases := range videoCodecNames {
+			if slices.Contains(aliases, names[f]) {
+				return codec, true
+			}
+		}
+	}
+	return "", false
+}
+
+// filterToCodec returns a copy of md restricted to the payload types for codec,
+// plus any rtx payloads associated with them. ok is false if Wowza doesn't offer codec.
+func filterToCodec(md *sdp.MediaDescription, codec string) (filtered *sdp.MediaDescription, ok bool) {
+	names := videoCodecNames[codec]
+	keep := make(map[string]bool)
+	for _, attr := range md.Attributes {
+		if attr.Key != "rtpmap" {
+			continue
+		}
+		if pt, name, valid := parseRtpmap(attr.Value); valid && slices.Contains(names, name) {
+			keep[pt] = true
+		}
+	}
+	if len(keep) == 0 {
+		return nil, false
+	}
+
+	// Retransmission payloads reference their primary via fmtp apt=<pt>
+	for _, attr := range md.Attributes {
+		if attr.Key != "fmtp" {
+			continue
+		}
+		pt, params, _ := strings.Cut(attr.Value, " ")
+		for _, p := range strings.Split(params, ";") {
+			if apt, found := strings.CutPrefix(strings.TrimSpace(p), "apt="); found && keep[apt] {
+				keep[pt] = true
+			}
+		}
+	}
+
+	out := *md
+	out.MediaName.Formats = nil
+	for _, f := range md.MediaName.Formats {
+		if keep[f] {
+			out.MediaName.Formats = append(out.MediaName.Formats, f)
+		}
+	}
+	out.Attributes = nil
+	for _, attr := range md.Attributes {
+		switch attr.Key {
+		case "rtpmap", "fmtp", "rtcp-fb", "imageattr", "framesize":
+			pt, _, _ := strings.Cut(attr.Value, " ")
+			if !keep[pt] && pt != "*" {
+				continue
+			}
+		}
+		out.Attributes = append(out.Attributes, attr)
+	}
+	return &out, true
+}
+
+// preferredVideoCodec picks the codec codecAny resolves to for md: the first of
+// prefs that both Wowza and the client offer, or Wowza's own first choice when
+// none is.
+func preferredVideoCodec(md *sdp.MediaDescription, client MediaInfo, prefs []string) (string, bool) {
+	common := intersectCodecs(client, md)
+	for _, codec := range prefs {
+		for _, name := range videoCodecNames[codec] {
+			if slices.Contains(common, name) {
+				return codec, true
+			}
+		}
+	}
+	return detectVideoCodec(md)
+}
+
+// selectWowzaMedia picks the nth (from 0) of Wowza's media sections for the
+// client section's type, so several client sections of one type map to Wowza's
+// sections in order. For video with a requested codec only sections offering
+// that codec count, filtered to it; codecAny filters each section to the codec
+// preferredVideoCodec picks.
+func selectWowzaMedia(desc *sdp.SessionDescription, client MediaInfo, opts AnswerOptions, nth int) (*sdp.MediaDescription, bool) {
+	mediaType := strings.ToLower(client.Type)
+	for _, md := range desc.MediaDescriptions {
+		if strings.ToLower(md.MediaName.Media) != mediaType {
+			continue
+		}
+		if mediaType == "video" && opts.Codec != "" {
+			want := opts.Codec
+			if want == codecAny {
+				want, _ = preferredVideoCodec(md, client, opts.CodecPreference)
+			}
+			filtered, ok := filterToCodec(md, want)
+			if !ok {
+				continue
+			}
+			md = filtered
+		}
+		if nth == 0 {
+			return md, true
+		}
+		nth--
+	}
+	return nil, false
+}
+
+// MissingMedia lists the media types the client offered and opts wants that
+// Wowza can't provide, e.g. "audio" for a video-only stream, or "video" when
+// Wowza doesn't offer opts.Codec.
+func MissingMedia(wowzaOffer, clientOffer string, opts AnswerOptions) []string {
+	var wowzaDesc sdp.SessionDescription
+	if err := wowzaDesc.Unmarshal([]byte(wowzaOffer)); err != nil {
+		return nil
+	}
+	var missing []string
+	for _, m := range ExtractMediaOrder(clientOffer) {
+		mediaType := strings.ToLower(m.Type)
+		if m.disabled() || !opts.wantsMedia(mediaType) || slices.Contains(missing, mediaType) {
+			continue
+		}
+		if _, ok := selectWowzaMedia(&wowzaDesc, m, opts, 0); !ok {
+			missing = append(missing, mediaType)
+		}
+	}
+	return missing
+}
+
+// candidateMatches reports whether a Wowza candidate belongs to the m-line at index.
+// The line index wins when present; otherwise sdpMid is compared against both the
+// client's mid and Wowza's own mid for that section.
+func candidateMatches(c WowzaICECandidate, index int, clientMid, wowzaMid string) bool {
+	if c.SDPMLineIndex != nil {
+		return int(*c.SDPMLineIndex) == index
+	}
+	if c.SDPMid == nil {
+		return false
+	}
+	return *c.SDPMid == clientMid || (wowzaMid != "" && *c.SDPMid == wowzaMid)
+}
+
+// capBandwidth limits b=AS to kbps, adding it if absent, and scales any b=TIAS
+// (bits per second) down to match. Lower values from Wowza are kept.
+func capBandwidth(bw []sdp.Bandwidth, kbps uint64) []sdp.Bandwidth {
+	hasAS := false
+	for i := range bw {
+		switch bw[i].Type {
+		case "AS":
+			hasAS = true
+			bw[i].Bandwidth = min(bw[i].Bandwidth, kbps)
+		case "TIAS":
+			bw[i].Bandwidth = min(bw[i].Bandwidth, kbps*1000)
+		}
+	}
+	if !hasAS {
+		bw = append(bw, sdp.Bandwidth{Type: "AS", Bandwidth: kbps})
+	}
+	return bw
+}
+
+// candidateType returns the value after "typ" in a candidate line, e.g. "relay".
+func candidateType(candidate string) string {
+	fields := strings.Fields(candidate)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "typ" {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// candidateKinds counts Wowza candidates by transport and type, keyed like
+// "udp/host" or "tcp/relay".
+func candidateKinds(candidates []WowzaICECandidate) map[string]int {
+	kinds := make(map[string]int)
+	for _, c := range candidates {
+		fields := strings.Fields(strings.TrimPrefix(c.Candidate, "candidate:"))
+		transport := "unknown"
+		if len(fields) > 2 {
+			transport = strings.ToLower(fields[2])
+		}
+		typ := candidateType(c.Candidate)
+		if typ == "" {
+			typ = "unknown"
+		}
+		kinds[transport+"/"+typ]++
+	}
+	return kinds
+}
+
+// candidateRank orders candidates for ReorderCandidates: UDP before TCP, and
+// host before reflexive before relay within each transport. Lower is better.
+func candidateRank(candidate string) int {
+	fields := strings.Fields(strings.TrimPrefix(candidate, "candidate:"))
+	rank := 0
+	if len(fields) > 2 && !strings.EqualFold(fields[2], "udp") {
+		rank = 3
+	}
+	switch candidateType(candidate) {
+	case "host":
+	case "srflx", "prflx":
+		rank++
+	default:
+		rank += 2
+	}
+	return rank
+}
+
+// reprioritizeCandidate rewrites the priority field to follow candidateRank,
+// using the RFC 8445 formula with a type preference that drops 20 per rank.
+// Browsers pair candidates by priority, so reordering alone changes nothing.
+func reprioritizeCandidate(candidate string) string {
+	prefix := ""
+	if strings.HasPrefix(candidate, "candidate:") {
+		prefix = "candidate:"
+	}
+	fields := strings.Fields(strings.TrimPrefix(candidate, prefix))
+	if len(fields) < 4 {
+		return candidate
+	}
+	component, err := strconv.Atoi(fields[1])
+	if err != nil || component < 1 || component > 256 {
+		return candidate
+	}
+	typePref := 126 - 20*candidateRank(candidate)
+	fields[3] = strconv.Itoa(typePref<<24 | 65535<<8 | (256 - component))
+	return prefix + strings.Join(fields, " ")
+}
+
+// reorderCandidates sorts candidates by candidateRank, keeping Wowza's order
+// within a rank, and rewrites their priorities to match.
+func reorderCandidates(candidates []string) []string {
+	slices.SortStableFunc(candidates, func(a, b string) int {
+		return candidateRank(a) - candidateRank(b)
+	})
+	for i, c := range candidates {
+		candidates[i] = reprioritizeCandidate(c)
+	}
+	return candidates
+}
+
+// rejectedMedia builds a port-0 inactive media section for a client m-line we can't serve.
+//
+// Leaving the section out instead isn't an option: RFC 8829 requires an answer
+// to carry exactly the offer's m-lines in the same order, and browsers fail
+// setRemoteDescription on one that doesn't. Renumbering mids breaks the same
+// check, since they must match the offer's.
+//
+// The section carries no a=rtcp-mux: it's outside the BUNDLE group and has
+// no transport, so browsers ignore transport attributes on it under any
+// bundle policy.
+func rejectedMedia(mediaType, mid string, creds *ICECredentials) *sdp.MediaDescription {
+	md := &sdp.MediaDescription{
+		MediaName: sdp.MediaName{
+			Media:   mediaType,
+			Port:    sdp.RangedPort{Value: 0},
+			Protos:  []string{"UDP", "TLS", "RTP", "SAVPF"},
+			Formats: []string{"0"},
+		},
+	}
+	md.Attributes = []sdp.Attribute{
+		{Key: "mid", Value: mid},
+		{Key: "ice-ufrag", Value: creds.IceUfrag},
+		{Key: "ice-pwd", Value: creds.IcePwd},
+		{Key: "fingerprint", Value: creds.Fingerprint},
+		{Key: "setup", Value: "passive"},
+		{Key: "inactive", Value: ""},
+	}
+	return md
+}
+
 // CreateAnswerForWowza creates an SDP answer for Wowza using the client's ICE/DTLS credentials.
 // This allows Wowza to connect directly to the client for media flow.
-func CreateAnswerForWowza(wowzaOffer, clientOffer string) (string, error) {
+func CreateAnswerForWowza(wowzaOffer, clientOffer string, opts AnswerOptions) (string, error) {
 	clientCreds, err := ExtractCredentials(clientOffer)
 	if err != nil {
 		return "", fmt.Errorf("extract client credentials: %w", err)
@@ -96,15 +793,23 @@ func CreateAnswerForWowza(wowzaOffer, clientOffer string) (string, error) {
 
 	answerDesc := wowzaDesc
 
-	// Replace session-level fingerprint
+	// Replace session-level fingerprint. A client offer with only per-media
+	// fingerprints falls back to the last one seen.
+	fingerprint := sessionFingerprint(clientOffer)
+	if fingerprint == "" {
+		fingerprint = clientCreds.Fingerprint
+	}
 	for i, attr := range answerDesc.Attributes {
-		if attr.Key == "fingerprint" && clientCreds.Fingerprint != "" {
-			answerDesc.Attributes[i] = sdp.Attribute{Key: "fingerprint", Value: clientCreds.Fingerprint}
+		if attr.Key == "fingerprint" && fingerprint != "" {
+			answerDesc.Attributes[i] = sdp.Attribute{Key: "fingerprint", Value: fingerprint}
 		}
 	}
 
 	// Update each media section with client's ICE/DTLS credentials
-	for _, md := range answerDesc.MediaDescriptions {
+	clientMedia := ExtractMediaOrder(clientOffer)
+	for i, md := range answerDesc.MediaDescriptions {
+		wanted := opts.wantsMedia(md.MediaName.Media)
+		mediaFP := mediaFingerprint(clientMedia, md.MediaName.Media, i, fingerprint)
 		filtered := make([]sdp.Attribute, 0, len(md.Attributes))
 		for _, attr := range md.Attributes {
 			switch attr.Key {
@@ -117,15 +822,27 @@ func CreateAnswerForWowza(wowzaOffer, clientOffer string) (string, error) {
 					filtered = append(filtered, sdp.Attribute{Key: "ice-pwd", Value: clientCreds.IcePwd})
 				}
 			case "fingerprint":
-				if clientCreds.Fingerprint != "" {
-					filtered = append(filtered, sdp.Attribute{Key: "fingerprint", Value: clientCreds.Fingerprint})
+				if mediaFP != "" {
+					filtered = append(filtered, sdp.Attribute{Key: "fingerprint", Value: mediaFP})
 				}
 			case "setup":
-				filtered = append(filtered, sdp.Attribute{Key: "setup", Value: "active"})
-			case "sendrecv":
-				filtered = append(filtered, sdp.Attribute{Key: "recvonly", Value: ""})
+				filtered = append(filtered, sdp.Attribute{Key: "setup", Value: opts.wowzaSetup(clientCreds.Setup)})
+			case "sendrecv", "sendonly", "recvonly", "inactive":
+				switch {
+				case !wanted:
+					// Ask Wowza not to send media the client opted out of
+					filtered = append(filtered, sdp.Attribute{Key: "inactive", Value: ""})
+				case attr.Key == "sendrecv":
+					filtered = append(filtered, sdp.Attribute{Key: "recvonly", Value: ""})
+				default:
+					filtered = append(filtered, attr)
+				}
 			case "candidate":
-				continue // Skip Wowza's candidates
+				if opts.KeepWowzaCandidates {
+					attr.Value = mapCandidateIP(attr.Value, opts.CandidateIPs)
+					filtered = append(filtered, attr)
+				}
+				// Otherwise skip Wowza's candidates
 			default:
 				filtered = append(filtered, attr)
 			}
@@ -133,7 +850,7 @@ func CreateAnswerForWowza(wowzaOffer, clientOffer string) (string, error) {
 
 		// Add client's ICE candidates
 		for _, cand := range clientCreds.Candidates {
-			filtered = append(filtered, sdp.Attribute{Key: "candidate", Value: cand})
+			filtered = append(filtered, sdp.Attribute{Key: "candidate", Value: strings.TrimPrefix(cand, "candidate:")})
 		}
 
 		md.Attributes = filtered
@@ -145,16 +862,72 @@ func CreateAnswerForWowza(wowzaOffer, clientOffer string) (string, error) {
 	}
 
 	result := string(bytes)
-	result = filterPrivateIPs(result)
+	result = filterPrivateIPs(result, opts.FilterIPv6)
 	result = addTrickleICE(result)
 
 	return result, nil
 }
 
+// validateAnswer re-parses a generated client answer and checks what browsers
+// require: every accepted section has a mid, ICE credentials, a fingerprint
+// and a setup role, and the BUNDLE group names exactly the accepted sections,
+// each of which has a=rtcp-mux. A max-bundle client fails on any accepted
+// section left outside the group or without rtcp-mux, and a degenerate Wowza
+// offer otherwise yields an answer setRemoteDescription rejects.
+func validateAnswer(answer string) error {
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(answer)); err != nil {
+		return fmt.Errorf("invalid answer: %w", err)
+	}
+
+	sessionFingerprint, _ := desc.Attribute("fingerprint")
+	accepted := make(map[string]bool)
+	for i, md := range desc.MediaDescriptions {
+		if md.MediaName.Port.Value == 0 {
+			continue
+		}
+		for _, key := range []string{"mid", "ice-ufrag", "ice-pwd", "setup"} {
+			if v, _ := md.Attribute(key); v == "" {
+				return fmt.Errorf("invalid answer: media section %d has no a=%s", i, key)
+			}
+		}
+		if _, ok := md.Attribute("rtcp-mux"); !ok {
+			return fmt.Errorf("invalid answer: media section %d has no a=rtcp-mux", i)
+		}
+		if fp, _ := md.Attribute("fingerprint"); fp == "" && sessionFingerprint == "" {
+			return fmt.Errorf("invalid answer: media section %d has no a=fingerprint", i)
+		}
+		mid, _ := md.Attribute("mid")
+		accepted[mid] = true
+	}
+
+	bundled := make(map[string]bool)
+	if group, ok := desc.Attribute("group"); ok {
+		mids, found := strings.CutPrefix(group, "BUNDLE")
+		if found && len(strings.Fields(mids)) == 0 {
+			return fmt.Errorf("invalid answer: empty BUNDLE group")
+		}
+		for _, mid := range strings.Fields(mids) {
+			if !accepted[mid] {
+				return fmt.Errorf("invalid answer: BUNDLE names mid %q with no accepted section", mid)
+			}
+			bundled[mid] = true
+		}
+	}
+	for mid := range accepted {
+		if !bundled[mid] {
+			return fmt.Errorf("invalid answer: accepted mid %q is not in the BUNDLE group", mid)
+		}
+	}
+	return nil
+}
+
 // CreateAnswerForClient creates an SDP answer for the WHEP client using Wowza's ICE/DTLS credentials.
 // The answer matches the client's offer structure (mid values, m-line order) but uses Wowza's
-// credentials and payload types for direct client-to-Wowza media flow.
-func CreateAnswerForClient(wowzaOffer, clientOffer string, wowzaCandidates []WowzaICECandidate) (string, error) {
+// credentials and payload types for direct client-to-Wowza media flow. When opts.Codec is set,
+// the video section is restricted to that codec and rejected if Wowza doesn't offer it; "any"
+// restricts it to Wowza's preferred codec, leaving an audio-only answer if Wowza has no video.
+func CreateAnswerForClient(wowzaOffer, clientOffer string, wowzaCandidates []WowzaICECandidate, opts AnswerOptions) (string, error) {
 	clientMedia := ExtractMediaOrder(clientOffer)
 
 	wowzaCreds, err := ExtractCredentials(wowzaOffer)
@@ -166,18 +939,29 @@ func CreateAnswerForClient(wowzaOffer, clientOffer string, wowzaCandidates []Wow
 		return "", fmt.Errorf("wowza offer missing fingerprint")
 	}
 
+	clientCreds, err := ExtractCredentials(clientOffer)
+	if err != nil {
+		return "", fmt.Errorf("extract client credentials: %w", err)
+	}
+	setup := opts.clientSetup(clientCreds.Setup)
+
 	var wowzaDesc sdp.SessionDescription
 	if err := wowzaDesc.Unmarshal([]byte(wowzaOffer)); err != nil {
 		return "", fmt.Errorf("parse wowza offer: %w", err)
 	}
 
-	// Build map of Wowza's media sections by type
-	wowzaMediaByType := make(map[string]*sdp.MediaDescription)
-	for _, md := range wowzaDesc.MediaDescriptions {
-		wowzaMediaByType[strings.ToLower(md.MediaName.Media)] = md
+	// Create answer with client's structure but Wowza's credentials
+	sessionName, originAddr, originType := "-", "127.0.0.1", "IP4"
+	if opts.SessionName != "" {
+		sessionName = opts.SessionName
+	}
+	if ip := net.ParseIP(opts.OriginAddress); ip != nil {
+		originAddr = ip.String()
+		if ip.To4() == nil {
+			originType = "IP6"
+		}
 	}
 
-	// Create answer with client's structure but Wowza's credentials
 	answerDesc := sdp.SessionDescription{
 		Version: 0,
 		Origin: sdp.Origin{
@@ -185,51 +969,54 @@ func CreateAnswerForClient(wowzaOffer, clientOffer string, wowzaCandidates []Wow
 			SessionID:      wowzaDesc.Origin.SessionID,
 			SessionVersion: wowzaDesc.Origin.SessionVersion,
 			NetworkType:    "IN",
-			AddressType:    "IP4",
-			UnicastAddress: "127.0.0.1",
+			AddressType:    originType,
+			UnicastAddress: originAddr,
 		},
-		SessionName: "-",
+		SessionName: sdp.SessionName(sessionName),
 		TimeDescriptions: []sdp.TimeDescription{
 			{Timing: sdp.Timing{StartTime: 0, StopTime: 0}},
 		},
 	}
 
-	// Build BUNDLE group with client's mid values
-	var bundleMids []string
-	for _, cm := range clientMedia {
-		bundleMids = append(bundleMids, cm.Mid)
-	}
-
-	answerDesc.Attributes = []sdp.Attribute{
-		{Key: "group", Value: "BUNDLE " + strings.Join(bundleMids, " ")},
-		{Key: "msid-semantic", Value: "WMS *"},
-		{Key: "fingerprint", Value: wowzaCreds.Fingerprint},
-	}
-
 	// Build media sections in client's order
+	relays := 0
+	seen := make(map[string]int) // Client sections answered so far per media type
 	for i, clientMediaInfo := range clientMedia {
 		mediaType := strings.ToLower(clientMediaInfo.Type)
-		wowzaMD, ok := wowzaMediaByType[mediaType]
+
+		// Bundle-only sections are answered like any other: port 9 and in the
+		// BUNDLE group, since answers never carry a=bundle-only
+		if clientMediaInfo.disabled() || !opts.wantsMedia(mediaType) {
+			answerDesc.MediaDescriptions = append(answerDesc.MediaDescriptions,
+				rejectedMedia(mediaType, clientMediaInfo.Mid, wowzaCreds))
+			continue
+		}
+
+		// A second section of a type (e.g. screen share next to a camera) maps to
+		// Wowza's second section of it. Past Wowza's sections, it reuses the first
+		// one's codecs but stays inactive, since binding Wowza's source to two
+		// transceivers would duplicate its SSRCs
+		nth := seen[mediaType]
+		seen[mediaType]++
+		wowzaMD, ok := selectWowzaMedia(&wowzaDesc, clientMediaInfo, opts, nth)
+		extra := false
+		if !ok && nth > 0 {
+			wowzaMD, ok = selectWowzaMedia(&wowzaDesc, clientMediaInfo, opts, 0)
+			extra = ok
+		}
 
 		if !ok {
 			// Reject media type not available from Wowza
-			md := &sdp.MediaDescription{
-				MediaName: sdp.MediaName{
-					Media:   mediaType,
-					Port:    sdp.RangedPort{Value: 0},
-					Protos:  []string{"UDP", "TLS", "RTP", "SAVPF"},
-					Formats: []string{"0"},
-				},
-			}
-			md.Attributes = []sdp.Attribute{
-				{Key: "mid", Value: clientMediaInfo.Mid},
-				{Key: "ice-ufrag", Value: wowzaCreds.IceUfrag},
-				{Key: "ice-pwd", Value: wowzaCreds.IcePwd},
-				{Key: "fingerprint", Value: wowzaCreds.Fingerprint},
-				{Key: "setup", Value: "passive"},
-				{Key: "inactive", Value: ""},
-			}
-			answerDesc.MediaDescriptions = append(answerDesc.MediaDescriptions, md)
+			answerDesc.MediaDescriptions = append(answerDesc.MediaDescriptions,
+				rejectedMedia(mediaType, clientMediaInfo.Mid, wowzaCreds))
+			continue
+		}
+
+		// Wowza's PTs are forced on the browser, so an audio section only works if the
+		// browser offered at least one of Wowza's codecs (e.g. Opus offered, PCMU sent)
+		if mediaType == "audio" && len(intersectCodecs(clientMediaInfo, wowzaMD)) == 0 {
+			answerDesc.MediaDescriptions = append(answerDesc.MediaDescriptions,
+				rejectedMedia(mediaType, clientMediaInfo.Mid, wowzaCreds))
 			continue
 		}
 
@@ -247,17 +1034,45 @@ func CreateAnswerForClient(wowzaOffer, clientOffer string, wowzaCandidates []Wow
 				AddressType: "IP4",
 				Address:     &sdp.Address{Address: "0.0.0.0"},
 			},
+			Bandwidth: slices.Clone(wowzaMD.Bandwidth),
+		}
+		if mediaType == "video" && opts.MaxVideoBitrate > 0 {
+			md.Bandwidth = capBandwidth(md.Bandwidth, uint64(opts.MaxVideoBitrate))
+		}
+
+		direction := clientMediaInfo.answerDirection()
+		if extra {
+			direction = "inactive"
 		}
 
 		var attrs []sdp.Attribute
 
-		// Copy codec attributes from Wowza
+		// Copy codec attributes from Wowza, plus the framerate and resolution
+		// hints players use to size their canvas. imageattr needs no swapping:
+		// the answer describes Wowza's side, so its "send" is still Wowza sending
 		for _, attr := range wowzaMD.Attributes {
 			switch attr.Key {
-			case "rtpmap", "fmtp", "rtcp-fb", "ssrc", "msid", "cliprect", "framesize", "control":
+			case "rtpmap", "fmtp", "rtcp-fb", "cliprect", "framesize", "framerate", "imageattr", "control":
+				attrs = append(attrs, attr)
+			case "ssrc", "msid":
+				if extra {
+					continue
+				}
+				if opts.RewriteMsid {
+					attr = rewriteMsid(attr, clientMediaInfo.Mid)
+				}
 				attrs = append(attrs, attr)
+			case "extmap":
+				// Keep Wowza's IDs since those are what it stamps on packets, but only
+				// for extensions the browser offered; it rejects anything else
+				if uri, ok := parseExtmap(attr.Value); ok && slices.Contains(clientMediaInfo.Extmap, uri) {
+					attrs = append(attrs, attr)
+				}
 			}
 		}
+		if attr, ok := playoutDelayExtmap(clientMediaInfo, attrs, opts); ok {
+			attrs = append(attrs, attr)
+		}
 
 		// Wowza's ICE/DTLS credentials for direct client-Wowza connection
 		attrs = append(attrs,
@@ -265,36 +1080,157 @@ func CreateAnswerForClient(wowzaOffer, clientOffer string, wowzaCandidates []Wow
 			sdp.Attribute{Key: "ice-pwd", Value: wowzaCreds.IcePwd},
 			sdp.Attribute{Key: "fingerprint", Value: wowzaCreds.Fingerprint},
 			// DTLS role: passive means Wowza waits for client to initiate DTLS handshake
-			sdp.Attribute{Key: "setup", Value: "passive"},
+			sdp.Attribute{Key: "setup", Value: setup},
 			// CRITICAL: Must use client's mid values, not Wowza's (video/audio vs 0/1)
 			sdp.Attribute{Key: "mid", Value: clientMediaInfo.Mid},
-			sdp.Attribute{Key: "sendonly", Value: ""},
+			sdp.Attribute{Key: direction, Value: ""},
 			sdp.Attribute{Key: "rtcp-mux", Value: ""},
 		)
+		if _, ok := wowzaMD.Attribute("rtcp-rsize"); ok && clientMediaInfo.Rsize {
+			attrs = append(attrs, sdp.Attribute{Key: "rtcp-rsize", Value: ""})
+		}
+		if !extra {
+			attrs = append(attrs, simulcastAttrs(clientMediaInfo, wowzaMD)...)
+		}
 
-		// Add ICE candidates for this media section
+		// Add ICE candidates for this media section, including component 2 (RTCP)
+		// candidates: some Wowza builds need them for connectivity despite rtcp-mux
+		wowzaMid, _ := wowzaMD.Attribute("mid")
+		var candidates []string
 		for _, c := range wowzaCandidates {
-			if c.SDPMLineIndex != nil && int(*c.SDPMLineIndex) == i {
-				cleaned := cleanWowzaCandidate(c.Candidate)
-				cleaned = strings.TrimPrefix(cleaned, "candidate:")
-				attrs = append(attrs, sdp.Attribute{Key: "candidate", Value: cleaned})
+			if !candidateMatches(c, i, clientMediaInfo.Mid, wowzaMid) {
+				continue
+			}
+			cleaned := cleanWowzaCandidate(c.Candidate)
+			cleaned = mapCandidateIP(strings.TrimPrefix(cleaned, "candidate:"), opts.CandidateIPs)
+			if candidateType(cleaned) == "relay" {
+				relays++
+			} else if opts.RelayOnly {
+				continue
 			}
+			candidates = append(candidates, cleaned)
+		}
+		if opts.ReorderCandidates {
+			candidates = reorderCandidates(candidates)
+		}
+		for _, c := range candidates {
+			attrs = append(attrs, sdp.Attribute{Key: "candidate", Value: c})
 		}
 
 		md.Attributes = attrs
 		answerDesc.MediaDescriptions = append(answerDesc.MediaDescriptions, md)
 	}
 
+	// BUNDLE group with client's mid values, in client order. Rejected (port 0)
+	// sections can't be bundled, so they're left out.
+	var bundleMids []string
+	for i, md := range answerDesc.MediaDescriptions {
+		if md.MediaName.Port.Value != 0 {
+			bundleMids = append(bundleMids, clientMedia[i].Mid)
+		}
+	}
+
+	answerDesc.Attributes = []sdp.Attribute{
+		{Key: "msid-semantic", Value: "WMS *"},
+		{Key: "fingerprint", Value: wowzaCreds.Fingerprint},
+	}
+	if opts.RelayOnly && len(bundleMids) > 0 && relays == 0 {
+		return "", ErrNoRelayCandidates
+	}
+	if len(bundleMids) > 0 {
+		answerDesc.Attributes = append([]sdp.Attribute{
+			{Key: "group", Value: "BUNDLE " + strings.Join(bundleMids, " ")},
+		}, answerDesc.Attributes...)
+	}
+
 	bytes, err := answerDesc.Marshal()
 	if err != nil {
 		return "", fmt.Errorf("marshal answer: %w", err)
 	}
 
-	return string(bytes), nil
+	answer := string(bytes)
+	if err := validateAnswer(answer); err != nil {
+		return "", err
+	}
+	return answer, nil
 }
 
-// filterPrivateIPs removes private and IPv6 candidates for Wowza Cloud compatibility
-func filterPrivateIPs(sdpStr string) string {
+// appendCandidates adds client candidate lines ("candidate:...") to every media
+// section of an answer for Wowza, skipping any already present. All sections
+// share one BUNDLE transport, so each gets the full set.
+func appendCandidates(sdpStr string, candidates []string, filterIPv6 bool) string {
+	lines := strings.Split(strings.TrimSuffix(sdpStr, "\r\n"), "\r\n")
+	existing := make(map[string]bool)
+	for _, line := range lines {
+		if strings.HasPrefix(line, "a=candidate:") {
+			existing[line] = true
+		}
+	}
+
+	var extra []string
+	for _, c := range candidates {
+		line := "a=" + c
+		if !existing[line] {
+			existing[line] = true
+			extra = append(extra, line)
+		}
+	}
+	if len(extra) == 0 {
+		return sdpStr
+	}
+
+	result := make([]string, 0, len(lines)+len(extra)*2)
+	inMedia := false
+	for _, line := range lines {
+		if strings.HasPrefix(line, "m=") {
+			if inMedia {
+				result = append(result, extra...)
+			}
+			inMedia = true
+		}
+		result = append(result, line)
+	}
+	if inMedia {
+		result = append(result, extra...)
+	}
+
+	return filterPrivateIPs(strings.Join(result, "\r\n")+"\r\n", filterIPv6)
+}
+
+// replaceICECredentials swaps every ice-ufrag/ice-pwd line in an SDP for new values.
+func replaceICECredentials(sdpStr, ufrag, pwd string) string {
+	lines := splitSDPLines(sdpStr)
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			lines[i] = "a=ice-ufrag:" + ufrag
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			lines[i] = "a=ice-pwd:" + pwd
+		}
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// iceRestartFragment reduces a full answer to the trickle-ice-sdpfrag returned for an
+// ICE restart: the new credentials, then each m-line with its mid and candidates.
+func iceRestartFragment(answer string) string {
+	creds, _ := ExtractCredentials(answer)
+
+	var b strings.Builder
+	b.WriteString("a=ice-ufrag:" + creds.IceUfrag + "\r\n")
+	b.WriteString("a=ice-pwd:" + creds.IcePwd + "\r\n")
+	for _, line := range splitSDPLines(answer) {
+		if strings.HasPrefix(line, "m=") || strings.HasPrefix(line, "a=mid:") || strings.HasPrefix(line, "a=candidate:") {
+			b.WriteString(line + "\r\n")
+		}
+	}
+	return b.String()
+}
+
+// filterPrivateIPs removes private candidates for Wowza Cloud compatibility. IPv6 candidates
+// are dropped entirely when filterIPv6 is set; otherwise global unicast IPv6 is kept while
+// link-local and ULA addresses are still removed.
+func filterPrivateIPs(sdpStr string, filterIPv6 bool) string {
 	lines := strings.Split(sdpStr, "\r\n")
 	filtered := make([]string, 0, len(lines))
 
@@ -306,7 +1242,7 @@ func filterPrivateIPs(sdpStr string) string {
 			parts := strings.Fields(line)
 			if len(parts) >= 5 {
 				ip := net.ParseIP(parts[4])
-				if ip != nil && (ip.To4() == nil || isPrivateIP(ip)) {
+				if ip != nil && !isUsableCandidateIP(ip, filterIPv6) {
 					continue
 				}
 			}
@@ -316,10 +1252,42 @@ func filterPrivateIPs(sdpStr string) string {
 	return strings.Join(filtered, "\r\n")
 }
 
+// mapCandidateIP rewrites a candidate's connection address through ips, for a
+// Wowza behind 1:1 NAT that advertises its private address. The "candidate:"
+// prefix is optional; unmapped addresses are returned unchanged.
+func mapCandidateIP(candidate string, ips map[string]string) string {
+	if len(ips) == 0 {
+		return candidate
+	}
+	fields := strings.Fields(candidate)
+	if len(fields) < 5 {
+		return candidate
+	}
+	ip := net.ParseIP(fields[4])
+	if ip == nil {
+		return candidate
+	}
+	public, ok := ips[ip.String()]
+	if !ok {
+		return candidate
+	}
+	fields[4] = public
+	return strings.Join(fields, " ")
+}
+
 func isPrivateIP(ip net.IP) bool {
 	return ip != nil && (ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast())
 }
 
+// isUsableCandidateIP reports whether Wowza can reach a client candidate at ip.
+// IsPrivate covers IPv6 ULA (fc00::/7) as well as RFC 1918.
+func isUsableCandidateIP(ip net.IP, filterIPv6 bool) bool {
+	if ip.To4() == nil {
+		return !filterIPv6 && ip.IsGlobalUnicast() && !isPrivateIP(ip)
+	}
+	return !isPrivateIP(ip)
+}
+
 // addTrickleICE adds trickle ICE option after ice-ufrag
 func addTrickleICE(sdpStr string) string {
 	if strings.Contains(sdpStr, "a=ice-options:trickle") {
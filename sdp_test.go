@@ -0,0 +1,495 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/sdp/v3"
+)
+
+func TestIsUsableCandidateIP(t *testing.T) {
+	tests := []struct {
+		ip         string
+		filterIPv6 bool
+		want       bool
+	}{
+		{"203.0.113.5", false, true},
+		{"10.0.0.5", false, false},
+		{"192.168.1.10", false, false},
+		{"127.0.0.1", false, false},
+		{"169.254.10.1", false, false},
+		{"2001:db8::1", false, true},
+		{"2001:db8::1", true, false},
+		{"fe80::1", false, false},
+		{"fd12:3456:789a::1", false, false},
+		{"fc00::1", false, false},
+		{"::1", false, false},
+		{"ff02::1", false, false},
+		{"203.0.113.5", true, true},
+	}
+	for _, tt := range tests {
+		if got := isUsableCandidateIP(net.ParseIP(tt.ip), tt.filterIPv6); got != tt.want {
+			t.Errorf("isUsableCandidateIP(%s, filterIPv6=%v) = %v, want %v", tt.ip, tt.filterIPv6, got, tt.want)
+		}
+	}
+}
+
+func TestFilterPrivateIPs(t *testing.T) {
+	const (
+		v4Public  = "a=candidate:1 1 udp 2122260223 203.0.113.5 50000 typ host"
+		v4Private = "a=candidate:2 1 udp 2122260223 192.168.1.10 50001 typ host"
+		v6Global  = "a=candidate:3 1 udp 2122262783 2001:db8::1 50002 typ host"
+		v6Link    = "a=candidate:4 1 udp 2122262783 fe80::1 50003 typ host"
+		v6ULA     = "a=candidate:5 1 udp 2122262783 fd12:3456:789a::1 50004 typ host"
+		mdns      = "a=candidate:6 1 udp 2122260223 4f1c2a3b-0000-4000-8000-000000000000.local 50005 typ host"
+	)
+	sdpStr := strings.Join([]string{
+		"v=0",
+		"m=video 9 UDP/TLS/RTP/SAVPF 96",
+		"a=mid:0",
+		v4Public, v4Private, v6Global, v6Link, v6ULA, mdns,
+		"a=end-of-candidates",
+		"",
+	}, "\r\n")
+
+	tests := []struct {
+		name       string
+		filterIPv6 bool
+		want       []string
+	}{
+		{"keep global v6", false, []string{v4Public, v6Global, mdns}},
+		{"filter v6", true, []string{v4Public, mdns}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := filterPrivateIPs(sdpStr, tt.filterIPv6)
+			var candidates []string
+			for _, line := range strings.Split(got, "\r\n") {
+				if strings.HasPrefix(line, "a=candidate:") {
+					candidates = append(candidates, line)
+				}
+			}
+			if strings.Join(candidates, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("candidates:\n%s\nwant:\n%s", strings.Join(candidates, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if strings.Contains(got, "a=end-of-candidates") {
+				t.Error("end-of-candidates was not removed")
+			}
+			if !strings.HasPrefix(got, "v=0\r\nm=video") {
+				t.Errorf("non-candidate lines changed:\n%s", got)
+			}
+		})
+	}
+}
+
+// wowzaVideoSection and the other fixture builders return one media section
+// of a test offer, CRLF-terminated.
+func wowzaVideoSection(mid, pt, codec string) string {
+	return "m=video 9 UDP/TLS/RTP/SAVPF " + pt + "\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"a=rtpmap:" + pt + " " + codec + "/90000\r\n" +
+		"a=mid:" + mid + "\r\n" +
+		"a=setup:actpass\r\n" +
+		"a=sendonly\r\n"
+}
+
+func wowzaAudioSection(mid string) string {
+	return "m=audio 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"a=rtpmap:96 opus/48000/2\r\n" +
+		"a=mid:" + mid + "\r\n" +
+		"a=sendonly\r\n"
+}
+
+func testWowzaOffer(sections ...string) string {
+	return "v=0\r\n" +
+		"o=- 1234 2 IN IP4 127.0.0.1\r\n" +
+		"s=-\r\n" +
+		"t=0 0\r\n" +
+		"a=ice-ufrag:wowz\r\n" +
+		"a=ice-pwd:wowzapasswordwowzapassword\r\n" +
+		"a=fingerprint:sha-256 AA:BB:CC\r\n" +
+		"a=setup:actpass\r\n" +
+		strings.Join(sections, "")
+}
+
+func clientSection(mediaType, mid string, codecs ...string) string {
+	var pts []string
+	var rtpmaps string
+	for i, codec := range codecs {
+		pt := strconv.Itoa(100 + i)
+		pts = append(pts, pt)
+		rate := "90000"
+		if mediaType == "audio" {
+			rate = "48000/2"
+		}
+		rtpmaps += "a=rtpmap:" + pt + " " + codec + "/" + rate + "\r\n"
+	}
+	return "m=" + mediaType + " 9 UDP/TLS/RTP/SAVPF " + strings.Join(pts, " ") + "\r\n" +
+		"c=IN IP4 0.0.0.0\r\n" +
+		"a=mid:" + mid + "\r\n" +
+		"a=recvonly\r\n" +
+		rtpmaps
+}
+
+func testClientOffer(setup string, sections ...string) string {
+	return "v=0\r\n" +
+		"o=- 5678 2 IN IP4 127.0.0.1\r\n" +
+		"s=-\r\n" +
+		"t=0 0\r\n" +
+		"a=ice-ufrag:clnt\r\n" +
+		"a=ice-pwd:clientpasswordclientpassword\r\n" +
+		"a=fingerprint:sha-256 DD:EE:FF\r\n" +
+		"a=setup:" + setup + "\r\n" +
+		strings.Join(sections, "")
+}
+
+// parseAnswer unmarshals answer, failing the test if it isn't valid SDP.
+func parseAnswer(t *testing.T, answer string) *sdp.SessionDescription {
+	t.Helper()
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(answer)); err != nil {
+		t.Fatalf("unmarshal answer: %v\n%s", err, answer)
+	}
+	return &desc
+}
+
+// mediaCandidates returns the candidate attributes of md.
+func mediaCandidates(md *sdp.MediaDescription) []string {
+	var out []string
+	for _, attr := range md.Attributes {
+		if attr.Key == "candidate" {
+			out = append(out, attr.Value)
+		}
+	}
+	return out
+}
+
+func TestCreateAnswerForClientCandidateByMid(t *testing.T) {
+	wowzaOffer := testWowzaOffer(wowzaVideoSection("video", "97", "H264"), wowzaAudioSection("audio"))
+	clientOffer := testClientOffer("actpass", clientSection("video", "0", "H264"), clientSection("audio", "1", "opus"))
+
+	mid := func(s string) *string { return &s }
+	candidates := []WowzaICECandidate{
+		// Client mid, no sdpMLineIndex
+		{Candidate: "candidate:1 1 udp 2130706431 203.0.113.5 1935 typ host", SDPMid: mid("0")},
+		// Wowza's own mid for the audio section, no sdpMLineIndex
+		{Candidate: "candidate:2 1 udp 2130706431 203.0.113.5 1936 typ host", SDPMid: mid("audio")},
+		// A mid neither side uses matches no section
+		{Candidate: "candidate:3 1 udp 2130706431 203.0.113.5 1937 typ host", SDPMid: mid("data")},
+	}
+
+	answer, err := CreateAnswerForClient(wowzaOffer, clientOffer, candidates, AnswerOptions{Codec: "h264"})
+	if err != nil {
+		t.Fatalf("CreateAnswerForClient: %v", err)
+	}
+	desc := parseAnswer(t, answer)
+	if len(desc.MediaDescriptions) != 2 {
+		t.Fatalf("got %d media sections, want 2", len(desc.MediaDescriptions))
+	}
+
+	want := [][]string{
+		{"1 1 udp 2130706431 203.0.113.5 1935 typ host"},
+		{"2 1 udp 2130706431 203.0.113.5 1936 typ host"},
+	}
+	for i, md := range desc.MediaDescriptions {
+		got := mediaCandidates(md)
+		if strings.Join(got, "\n") != strings.Join(want[i], "\n") {
+			t.Errorf("section %d candidates = %q, want %q", i, got, want[i])
+		}
+	}
+}
+
+func TestDTLSRoles(t *testing.T) {
+	tests := []struct {
+		role, offered   string
+		client, toWowza string
+	}{
+		{"auto", "actpass", "passive", "active"},
+		{"auto", "active", "passive", "active"},
+		{"auto", "passive", "active", "passive"},
+		{"active", "actpass", "active", "passive"},
+		{"active", "active", "active", "passive"},
+		{"active", "passive", "active", "passive"},
+		{"passive", "actpass", "passive", "active"},
+		{"passive", "active", "passive", "active"},
+		{"passive", "passive", "passive", "active"},
+	}
+	wowzaOffer := testWowzaOffer(wowzaVideoSection("video", "97", "H264"))
+	for _, tt := range tests {
+		t.Run(tt.role+"/"+tt.offered, func(t *testing.T) {
+			opts := AnswerOptions{DTLSRole: tt.role}
+			if got := opts.clientSetup(tt.offered); got != tt.client {
+				t.Errorf("clientSetup = %q, want %q", got, tt.client)
+			}
+			if got := opts.wowzaSetup(tt.offered); got != tt.toWowza {
+				t.Errorf("wowzaSetup = %q, want %q", got, tt.toWowza)
+			}
+
+			clientOffer := testClientOffer(tt.offered, clientSection("video", "0", "H264"))
+			answer, err := CreateAnswerForClient(wowzaOffer, clientOffer, nil, opts)
+			if err != nil {
+				t.Fatalf("CreateAnswerForClient: %v", err)
+			}
+			setup, _ := parseAnswer(t, answer).MediaDescriptions[0].Attribute("setup")
+			if setup != tt.client {
+				t.Errorf("client answer a=setup:%s, want %s", setup, tt.client)
+			}
+
+			answer, err = CreateAnswerForWowza(wowzaOffer, clientOffer, opts)
+			if err != nil {
+				t.Fatalf("CreateAnswerForWowza: %v", err)
+			}
+			setup, _ = parseAnswer(t, answer).MediaDescriptions[0].Attribute("setup")
+			if setup != tt.toWowza {
+				t.Errorf("Wowza answer a=setup:%s, want %s", setup, tt.toWowza)
+			}
+		})
+	}
+}
+
+func TestEnsureMids(t *testing.T) {
+	const header = "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\ns=-\r\nt=0 0\r\n"
+	tests := []struct {
+		name  string
+		offer string
+		want  string // Expected synthesized offer; "" when the offer is returned unchanged
+	}{
+		{
+			name:  "all mids present",
+			offer: header + "m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:v\r\n",
+		},
+		{
+			name:  "mid inserted ahead of attributes",
+			offer: header + "m=video 9 UDP/TLS/RTP/SAVPF 96\r\nc=IN IP4 0.0.0.0\r\na=rtpmap:96 VP8/90000\r\n",
+			want:  header + "m=video 9 UDP/TLS/RTP/SAVPF 96\r\nc=IN IP4 0.0.0.0\r\na=mid:0\r\na=rtpmap:96 VP8/90000\r\n",
+		},
+		{
+			name:  "section with no attribute lines",
+			offer: header + "m=audio 9 UDP/TLS/RTP/SAVPF 111\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:v\r\n",
+			want:  header + "m=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:v\r\n",
+		},
+		{
+			name:  "last section with no attribute lines and trailing empty line",
+			offer: header + "m=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:a\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\n",
+			want:  header + "m=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:a\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:1\r\n",
+		},
+		{
+			name:  "last section with no trailing newline",
+			offer: header + "m=video 9 UDP/TLS/RTP/SAVPF 96",
+			want:  header + "m=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:0\r\n",
+		},
+		{
+			name:  "index already in use",
+			offer: header + "m=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:1\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=sendonly\r\n",
+			want:  header + "m=audio 9 UDP/TLS/RTP/SAVPF 111\r\na=mid:1\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\na=mid:0\r\na=sendonly\r\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Run("reject", func(t *testing.T) {
+				got, err := EnsureMids(tt.offer, false)
+				if tt.want == "" {
+					if err != nil || got != tt.offer {
+						t.Errorf("EnsureMids = %q, %v; want offer unchanged", got, err)
+					}
+					return
+				}
+				if !errors.Is(err, ErrMissingMid) {
+					t.Errorf("EnsureMids error = %v, want ErrMissingMid", err)
+				}
+			})
+			t.Run("synthesize", func(t *testing.T) {
+				want := tt.want
+				if want == "" {
+					want = tt.offer
+				}
+				got, err := EnsureMids(tt.offer, true)
+				if err != nil {
+					t.Fatalf("EnsureMids: %v", err)
+				}
+				if got != want {
+					t.Errorf("EnsureMids =\n%q\nwant\n%q", got, want)
+				}
+			})
+		})
+	}
+}
+
+func TestCreateAnswerForClientTwoVideoSections(t *testing.T) {
+	twoVideo := testWowzaOffer(
+		wowzaVideoSection("v0", "97", "H264"),
+		wowzaVideoSection("v1", "98", "VP8"),
+		wowzaAudioSection("a"),
+	)
+	oneVideo := testWowzaOffer(wowzaVideoSection("v0", "97", "H264"), wowzaAudioSection("a"))
+
+	// section is the expected answer for one client section: its formats, or
+	// nil for a rejected (port 0) section, and its direction
+	type section struct {
+		formats   []string
+		direction string
+	}
+	tests := []struct {
+		name   string
+		wowza  string
+		client []string
+		codec  string
+		want   []section
+	}{
+		{
+			name:   "any picks a codec per section",
+			wowza:  twoVideo,
+			client: []string{clientSection("video", "0", "H264"), clientSection("video", "1", "VP8")},
+			codec:  codecAny,
+			want:   []section{{[]string{"97"}, "sendonly"}, {[]string{"98"}, "sendonly"}},
+		},
+		{
+			name:   "requested codec maps both sections to the only matching one",
+			wowza:  twoVideo,
+			client: []string{clientSection("video", "0", "H264", "VP8"), clientSection("video", "1", "H264", "VP8")},
+			codec:  "vp8",
+			want:   []section{{[]string{"98"}, "sendonly"}, {[]string{"98"}, "inactive"}},
+		},
+		{
+			name:   "second section past Wowza's is inactive",
+			wowza:  oneVideo,
+			client: []string{clientSection("video", "0", "H264"), clientSection("video", "1", "H264"), clientSection("audio", "2", "opus")},
+			codec:  "h264",
+			want:   []section{{[]string{"97"}, "sendonly"}, {[]string{"97"}, "inactive"}, {[]string{"96"}, "sendonly"}},
+		},
+		{
+			name:   "codec Wowza doesn't offer rejects both sections",
+			wowza:  twoVideo,
+			client: []string{clientSection("video", "0", "H264"), clientSection("video", "1", "VP8"), clientSection("audio", "2", "opus")},
+			codec:  "vp9",
+			want:   []section{{nil, ""}, {nil, ""}, {[]string{"96"}, "sendonly"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientOffer := testClientOffer("actpass", tt.client...)
+			answer, err := CreateAnswerForClient(tt.wowza, clientOffer, nil, AnswerOptions{Codec: tt.codec})
+			if err != nil {
+				t.Fatalf("CreateAnswerForClient: %v", err)
+			}
+			desc := parseAnswer(t, answer)
+			if len(desc.MediaDescriptions) != len(tt.want) {
+				t.Fatalf("got %d media sections, want %d", len(desc.MediaDescriptions), len(tt.want))
+			}
+			for i, md := range desc.MediaDescriptions {
+				want := tt.want[i]
+				if want.formats == nil {
+					if md.MediaName.Port.Value != 0 {
+						t.Errorf("section %d: port %d, want rejected", i, md.MediaName.Port.Value)
+					}
+					continue
+				}
+				if md.MediaName.Port.Value == 0 {
+					t.Errorf("section %d rejected, want formats %v", i, want.formats)
+					continue
+				}
+				if !slices.Equal(md.MediaName.Formats, want.formats) {
+					t.Errorf("section %d formats = %v, want %v", i, md.MediaName.Formats, want.formats)
+				}
+				if _, ok := md.Attribute(want.direction); !ok {
+					t.Errorf("section %d: missing a=%s", i, want.direction)
+				}
+			}
+
+			missing := MissingMedia(tt.wowza, clientOffer, AnswerOptions{Codec: tt.codec})
+			if rejected := tt.want[0].formats == nil; rejected != slices.Contains(missing, "video") {
+				t.Errorf("MissingMedia = %v, video rejected = %v", missing, rejected)
+			}
+		})
+	}
+}
+
+func TestCreateAnswerForClientPlayoutDelay(t *testing.T) {
+	const (
+		absSendTime = "http://www.webrtc.org/experiments/rtp-hdrext/abs-send-time"
+		wowzaExt    = "a=extmap:3 " + absSendTime + "\r\n"
+	)
+	client := func(playoutID string) string {
+		return testClientOffer("actpass", clientSection("video", "0", "H264")+
+			"a=extmap:3 "+absSendTime+"\r\n"+
+			"a=extmap:"+playoutID+" "+playoutDelayURI+"\r\n")
+	}
+
+	tests := []struct {
+		name     string
+		wowza    string
+		client   string
+		min, max time.Duration
+		want     string // Expected playout-delay extmap value; "" for none
+	}{
+		{
+			name:   "not configured",
+			wowza:  testWowzaOffer(wowzaVideoSection("v", "97", "H264") + wowzaExt),
+			client: client("12"),
+		},
+		{
+			name:   "injected under the client's ID",
+			wowza:  testWowzaOffer(wowzaVideoSection("v", "97", "H264") + wowzaExt),
+			client: client("12"),
+			min:    0,
+			max:    100 * time.Millisecond,
+			want:   "12 " + playoutDelayURI + " min=0;max=100",
+		},
+		{
+			name:   "Wowza's own extmap wins",
+			wowza:  testWowzaOffer(wowzaVideoSection("v", "97", "H264") + wowzaExt + "a=extmap:5 " + playoutDelayURI + "\r\n"),
+			client: client("12"),
+			max:    100 * time.Millisecond,
+			want:   "5 " + playoutDelayURI,
+		},
+		{
+			name:   "clamped and rounded",
+			wowza:  testWowzaOffer(wowzaVideoSection("v", "97", "H264") + wowzaExt),
+			client: client("12"),
+			min:    -time.Second,
+			max:    time.Minute,
+			want:   "12 " + playoutDelayURI + " min=0;max=40950",
+		},
+		{
+			name:   "max raised to min",
+			wowza:  testWowzaOffer(wowzaVideoSection("v", "97", "H264") + wowzaExt),
+			client: client("12"),
+			min:    205 * time.Millisecond,
+			max:    50 * time.Millisecond,
+			want:   "12 " + playoutDelayURI + " min=200;max=200",
+		},
+		{
+			name:   "client ID taken by a Wowza extmap",
+			wowza:  testWowzaOffer(wowzaVideoSection("v", "97", "H264") + wowzaExt),
+			client: client("3"),
+			max:    100 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := AnswerOptions{Codec: "h264", MinPlayoutDelay: tt.min, MaxPlayoutDelay: tt.max}
+			answer, err := CreateAnswerForClient(tt.wowza, tt.client, nil, opts)
+			if err != nil {
+				t.Fatalf("CreateAnswerForClient: %v", err)
+			}
+			var got []string
+			for _, attr := range parseAnswer(t, answer).MediaDescriptions[0].Attributes {
+				if uri, _ := parseExtmap(attr.Value); attr.Key == "extmap" && uri == playoutDelayURI {
+					got = append(got, attr.Value)
+				}
+			}
+			switch {
+			case tt.want == "" && len(got) != 0:
+				t.Errorf("playout-delay extmap = %q, want none", got)
+			case tt.want != "" && (len(got) != 1 || got[0] != tt.want):
+				t.Errorf("playout-delay extmap = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
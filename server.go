@@ -1,16 +1,31 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"path"
 	"regexp"
+	"runtime/debug"
+	"strconv"
 	"strings"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type Server struct {
@@ -18,54 +33,146 @@ type Server struct {
 	mgr    *Manager
 	logger *slog.Logger
 	server *http.Server
+	routes *http.ServeMux
+	probe  *wowzaProbe // nil in dynamic mode
+
+	publicBase string // PublicBaseURL prepended to resource paths; "" keeps them relative
+
+	accessLog io.Writer // Combined-format access log; nil logs requests through slog
 }
 
 func NewServer(cfg *Config, mgr *Manager, logger *slog.Logger) *Server {
-	return &Server{cfg: cfg, mgr: mgr, logger: logger}
+	s := &Server{cfg: cfg, mgr: mgr, logger: logger}
+	if cfg.WowzaWSURL != "" {
+		s.probe = newWowzaProbe(cfg)
+	}
+	return s
 }
 
 // Start runs the HTTP server until ctx is cancelled.
 func (s *Server) Start(ctx context.Context) error {
-	mux := http.NewServeMux()
-	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-	mux.HandleFunc("/whep/", s.handleWHEP)
-	mux.HandleFunc("/whep/cloud/", s.handleWHEPCloud)
-	mux.HandleFunc("/health", s.handleHealth)
-	mux.HandleFunc("/stats", s.handleStats)
+	s.routes = s.newMux()
+
+	publicBase, err := s.cfg.publicBaseURL()
+	if err != nil {
+		return err
+	}
+	s.publicBase = publicBase
+	if err := s.cfg.validateSDPOrigin(); err != nil {
+		return err
+	}
+	if err := s.cfg.validateAllowLists(); err != nil {
+		return err
+	}
+	if _, err := s.cfg.wowzaProxy(); err != nil {
+		return err
+	}
+
+	switch s.cfg.AccessLogFormat {
+	case "", "slog":
+	case "combined":
+		w, err := openAccessLog(s.cfg.AccessLog)
+		if err != nil {
+			return err
+		}
+		s.accessLog = w
+	default:
+		return fmt.Errorf("unsupported access log format %q (want slog or combined)", s.cfg.AccessLogFormat)
+	}
 
 	s.server = &http.Server{
 		Addr:              s.cfg.ListenAddr,
-		Handler:           s.withLogging(s.withCORS(mux)),
+		Handler:           s.handler(),
 		ReadTimeout:       30 * time.Second,
 		WriteTimeout:      30 * time.Second,
 		IdleTimeout:       60 * time.Second,
 		ReadHeaderTimeout: 10 * time.Second,
 	}
 
+	tlsCfg, err := s.tlsConfig(ctx)
+	if err != nil {
+		return err
+	}
+	s.server.TLSConfig = tlsCfg
+
+	if addr := s.cfg.PprofAddr; addr != "" {
+		if err := servePprof(ctx, addr, s.logger); err != nil {
+			return err
+		}
+	}
+
+	ln, err := s.listen()
+	if err != nil {
+		return err
+	}
+
 	errCh := make(chan error, 1)
 	go func() {
-		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		serve := s.server.Serve
+		if tlsCfg != nil {
+			serve = func(ln net.Listener) error { return s.server.ServeTLS(ln, "", "") }
+		}
+		if err := serve(ln); err != nil && err != http.ErrServerClosed {
 			errCh <- err
 		}
 		close(errCh)
 	}()
 
-	s.logger.Info("HTTP server started", "address", s.cfg.ListenAddr)
+	s.logger.Info("HTTP server started", "address", s.cfg.ListenAddr, "tls", tlsCfg != nil)
 
 	select {
 	case err := <-errCh:
 		return err
 	case <-ctx.Done():
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
 		defer cancel()
 		return s.Stop(shutdownCtx)
 	}
 }
 
-// Stop gracefully shuts down the server.
+// listen opens ListenAddr: a TCP address, or "unix:/path" for a Unix socket
+// created with SocketMode permissions. A stale socket left by an unclean exit
+// is removed first; any other file at the path is left alone.
+func (s *Server) listen() (net.Listener, error) {
+	sockPath, ok := strings.CutPrefix(s.cfg.ListenAddr, "unix:")
+	if !ok {
+		return net.Listen("tcp", s.cfg.ListenAddr)
+	}
+
+	mode, err := strconv.ParseUint(s.cfg.SocketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socket mode %q: %w", s.cfg.SocketMode, err)
+	}
+	if fi, err := os.Lstat(sockPath); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(sockPath); err != nil {
+			return nil, fmt.Errorf("remove stale socket: %w", err)
+		}
+	}
+
+	ln, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(sockPath, os.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("chmod socket: %w", err)
+	}
+	return ln, nil
+}
+
+// Stop gracefully shuts down the server. The HTTP server gets a third of ctx's
+// budget to finish in-flight requests; sessions get whatever remains to drain.
 func (s *Server) Stop(ctx context.Context) error {
 	if s.server != nil {
-		_ = s.server.Shutdown(ctx)
+		httpCtx := ctx
+		if deadline, ok := ctx.Deadline(); ok {
+			var cancel context.CancelFunc
+			httpCtx, cancel = context.WithTimeout(ctx, time.Until(deadline)/3)
+			defer cancel()
+		}
+		if err := s.server.Shutdown(httpCtx); err != nil {
+			s.logger.Warn("HTTP shutdown incomplete", "error", err)
+		}
 	}
 	return s.mgr.Shutdown(ctx)
 }
@@ -73,7 +180,7 @@ func (s *Server) Stop(ctx context.Context) error {
 // Static mode: /whep/{codec}/{app}/{stream}
 func (s *Server) handleWHEP(w http.ResponseWriter, r *http.Request) {
 	if s.cfg.WowzaWSURL == "" {
-		http.Error(w, "websocket URL not configured - use /whep/cloud/ or start with -websocket flag", http.StatusServiceUnavailable)
+		writeJSONError(w, http.StatusServiceUnavailable, errCodeNotConfigured, "websocket URL not configured - use /whep/cloud/ or start with -websocket flag")
 		return
 	}
 
@@ -81,11 +188,11 @@ func (s *Server) handleWHEP(w http.ResponseWriter, r *http.Request) {
 	urlPath = strings.TrimPrefix(urlPath, "/")
 
 	if urlPath == "" {
-		http.Error(w, "format: /whep/{codec}/{app}/{stream} where codec is h264 or vp8", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidPath, "format: /whep/{codec}/{app}/{stream} where codec is h264, vp8, vp9, h265 or any")
 		return
 	}
 
-	// Check for session operations (DELETE, PATCH)
+	// Check for session operations (GET, PATCH, DELETE)
 	parts := strings.Split(urlPath, "/")
 	if len(parts) > 0 && strings.HasPrefix(parts[len(parts)-1], "session-") {
 		sessionID := parts[len(parts)-1]
@@ -95,13 +202,13 @@ func (s *Server) handleWHEP(w http.ResponseWriter, r *http.Request) {
 
 	// Parse codec from first path segment
 	if len(parts) < 3 {
-		http.Error(w, "format: /whep/{codec}/{app}/{stream} where codec is h264 or vp8", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidPath, "format: /whep/{codec}/{app}/{stream} where codec is h264, vp8, vp9, h265 or any")
 		return
 	}
 
 	codec := strings.ToLower(parts[0])
-	if codec != "h264" && codec != "vp8" {
-		http.Error(w, "codec must be h264 or vp8", http.StatusBadRequest)
+	if !IsSupportedCodec(codec) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidCodec, "codec must be h264, vp8, vp9, h265 or any")
 		return
 	}
 
@@ -109,17 +216,17 @@ func (s *Server) handleWHEP(w http.ResponseWriter, r *http.Request) {
 	remaining := strings.Join(parts[1:], "/")
 	appName, streamName, err := parseAppStream(remaining)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidPath, err.Error())
 		return
 	}
 
 	switch r.Method {
 	case http.MethodPost:
-		s.handleCreate(w, r, appName, streamName, s.cfg.WowzaWSURL)
+		s.handleCreate(w, r, appName, streamName, codec, s.cfg.WowzaWSURL)
 	case http.MethodOptions:
 		s.writeWHEPOptions(w)
 	default:
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, allowCreate)
 	}
 }
 
@@ -129,7 +236,7 @@ func (s *Server) handleWHEPCloud(w http.ResponseWriter, r *http.Request) {
 	urlPath = strings.TrimPrefix(urlPath, "/")
 
 	if urlPath == "" {
-		http.Error(w, "format: /whep/cloud/{codec}/{host}/{app}/{stream} where codec is h264 or vp8", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidPath, "format: /whep/cloud/{codec}/{host}/{app}/{stream} where codec is h264, vp8, vp9, h265 or any")
 		return
 	}
 
@@ -145,13 +252,13 @@ func (s *Server) handleWHEPCloud(w http.ResponseWriter, r *http.Request) {
 
 	// Need at least: codec/host/app/stream
 	if len(parts) < 4 {
-		http.Error(w, "format: /whep/cloud/{codec}/{host}/{app}/{stream} where codec is h264 or vp8", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidPath, "format: /whep/cloud/{codec}/{host}/{app}/{stream} where codec is h264, vp8, vp9, h265 or any")
 		return
 	}
 
 	codec := strings.ToLower(parts[0])
-	if codec != "h264" && codec != "vp8" {
-		http.Error(w, "codec must be h264 or vp8", http.StatusBadRequest)
+	if !IsSupportedCodec(codec) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidCodec, "codec must be h264, vp8, vp9, h265 or any")
 		return
 	}
 
@@ -159,14 +266,14 @@ func (s *Server) handleWHEPCloud(w http.ResponseWriter, r *http.Request) {
 
 	// Validate host
 	if !isValidHost(host) {
-		http.Error(w, "invalid host", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidHost, "invalid host")
 		return
 	}
 
 	// Check allowed hosts
 	if !s.cfg.IsHostAllowed(host) {
-		s.logger.Warn("host not allowed", "host", host)
-		http.Error(w, "host not allowed", http.StatusForbidden)
+		s.log(r).Warn("host not allowed", "host", host)
+		writeJSONError(w, http.StatusForbidden, errCodeHostNotAllowed, "host not allowed")
 		return
 	}
 
@@ -174,7 +281,7 @@ func (s *Server) handleWHEPCloud(w http.ResponseWriter, r *http.Request) {
 	remaining := strings.Join(parts[2:], "/")
 	appName, streamName, err := parseAppStream(remaining)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidPath, err.Error())
 		return
 	}
 
@@ -190,72 +297,157 @@ func (s *Server) handleWHEPCloud(w http.ResponseWriter, r *http.Request) {
 
 	switch r.Method {
 	case http.MethodPost:
-		s.handleCreate(w, r, appName, streamName, wsURL)
+		s.handleCreate(w, r, appName, streamName, codec, wsURL)
 	case http.MethodOptions:
 		s.writeWHEPOptions(w)
 	default:
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, allowCreate)
 	}
 }
 
-func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request, appName, streamName, wsURL string) {
-	offer, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request, appName, streamName, codec, wsURL string) {
+	offer, err := readBody(r, s.cfg.MaxOfferSize)
+	if errors.Is(err, errBodyTooLarge) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, errCodePayloadTooLarge, fmt.Sprintf("SDP offer exceeds %d bytes", s.cfg.MaxOfferSize))
+		return
+	}
 	if err != nil {
-		http.Error(w, "failed to read offer", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidOffer, "failed to read offer")
 		return
 	}
 	defer r.Body.Close()
 
 	if len(offer) == 0 {
-		http.Error(w, "empty SDP offer", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidOffer, "empty SDP offer")
 		return
 	}
 
 	contentType := r.Header.Get("Content-Type")
 	if !strings.Contains(contentType, "application/sdp") {
-		http.Error(w, "Content-Type must be application/sdp", http.StatusUnsupportedMediaType)
+		writeJSONError(w, http.StatusUnsupportedMediaType, errCodeUnsupportedMedia, "Content-Type must be application/sdp")
+		return
+	}
+
+	media := strings.ToLower(r.URL.Query().Get("media"))
+	if media != "" && media != "audio" && media != "video" {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "media must be audio or video")
+		return
+	}
+
+	clientOffer, err := EnsureMids(string(offer), s.cfg.SynthesizeMids)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidOffer, err.Error())
+		return
+	}
+
+	// Query token wins over one embedded in the stream segment; neither is ever logged
+	streamName, token := splitStreamToken(streamName)
+	if q := r.URL.Query().Get("token"); q != "" {
+		token = q
+	}
+	if token != "" && !tokenRe.MatchString(token) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "invalid token")
+		return
+	}
+
+	if !s.cfg.IsAppAllowed(appName) {
+		s.log(r).Warn("app not allowed", "app", appName)
+		writeJSONError(w, http.StatusForbidden, errCodeAppNotAllowed, "app not allowed")
+		return
+	}
+	if !s.cfg.IsStreamAllowed(appName, streamName) {
+		s.log(r).Warn("stream not allowed", "app", appName, "stream", streamName)
+		writeJSONError(w, http.StatusForbidden, errCodeStreamNotAllowed, "stream not allowed")
 		return
 	}
 
-	s.logger.Info("WHEP create request",
+	clientIP := s.cfg.ClientIP(r)
+	s.log(r).Info("WHEP create request",
+		"client_ip", clientIP,
 		"app", appName,
 		"stream", streamName,
+		"codec", codec,
 		"user_agent", r.Header.Get("User-Agent"),
 	)
 
-	sessionID, session, err := s.mgr.Create(appName, streamName, wsURL)
+	sessionID, session, err := s.mgr.Create(r.Context(), appName, streamName, codec, wsURL, clientIP)
+	if errors.Is(err, ErrDraining) {
+		w.Header().Set("Retry-After", "30")
+		writeJSONError(w, http.StatusServiceUnavailable, errCodeDraining, "gateway is draining")
+		return
+	}
+	if errors.Is(err, ErrMaintenance) {
+		w.Header().Set("Retry-After", "60")
+		writeJSONError(w, http.StatusServiceUnavailable, errCodeMaintenance, "the gateway is down for maintenance, please try again later")
+		return
+	}
+	if errors.Is(err, ErrSessionLimit) {
+		s.log(r).Warn("rejecting session", "error", err)
+		w.Header().Set("Retry-After", "5")
+		writeJSONError(w, http.StatusServiceUnavailable, errCodeSessionLimit, "too many sessions")
+		return
+	}
+	var rlErr *RateLimitError
+	if errors.As(err, &rlErr) {
+		s.log(r).Warn("rejecting session", "error", err)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rlErr.RetryAfter.Seconds()))))
+		writeJSONError(w, http.StatusTooManyRequests, errCodeRateLimited, "rate limit exceeded")
+		return
+	}
 	if err != nil {
-		s.logger.Error("failed to create session", "error", err)
-		http.Error(w, "failed to create session", http.StatusInternalServerError)
+		s.log(r).Error("failed to create session", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "failed to create session")
 		return
 	}
 
-	answer, err := session.Negotiate(string(offer))
+	if token != "" {
+		session.SetSecureToken(token)
+	}
+	session.SetUserData(s.cfg.UserData(r.Header))
+	session.SetMedia(media)
+
+	answer, err := session.Negotiate(r.Context(), clientOffer)
 	if err != nil {
-		s.logger.Error("signaling failed", "session_id", sessionID, "error", err)
+		s.log(r).Error("signaling failed", "session_id", sessionID, "error", err)
 		s.mgr.Remove(sessionID)
-
-		status := http.StatusBadGateway
-		msg := "signaling failed"
-		if strings.Contains(err.Error(), "wowza error") {
-			msg = err.Error()
+		// Busy is local congestion with its own Retry-After and a client that
+		// went away says nothing about Wowza, so neither counts as a failure
+		if !errors.Is(err, ErrNegotiationBusy) && r.Context().Err() == nil && isUpstreamFailure(err) {
+			if wait := s.mgr.SignalingFailed(wsURL); wait > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			}
 		}
-		http.Error(w, msg, status)
+		writeSignalingError(w, err, "signaling failed")
 		return
 	}
+	s.mgr.SignalingSucceeded(wsURL)
 
-	s.logger.Debug("SDP answer", "sdp", answer)
+	s.log(r).Debug("SDP answer", "sdp", answer)
 
-	resourcePath := path.Join(r.URL.Path, sessionID)
-	w.Header().Set("Content-Type", "application/sdp")
+	resourcePath := s.publicBase + path.Join(s.cfg.RoutePrefix(), r.URL.Path, sessionID)
 	w.Header().Set("Location", resourcePath)
+	w.Header().Set("ETag", session.ETag())
 	w.Header().Set("Accept-Patch", "application/trickle-ice-sdpfrag")
-	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"ice-server\"", resourcePath))
+	w.Header().Add("Vary", "Accept")
+	for _, srv := range s.cfg.ICEServerList() {
+		w.Header().Add("Link", iceServerLink(srv))
+	}
 
-	w.WriteHeader(http.StatusCreated)
-	_, _ = w.Write([]byte(answer))
+	if prefersJSON(r.Header.Get("Accept")) {
+		resp := createResponse{SDP: answer, SessionID: sessionID, Location: resourcePath}
+		if s.cfg.SessionTTL > 0 {
+			resp.ExpiresAt = time.Now().Add(s.cfg.SessionTTL).UTC().Format(time.RFC3339)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(resp)
+	} else {
+		w.Header().Set("Content-Type", "application/sdp")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(answer))
+	}
 
-	s.logger.Info("WHEP session created",
+	s.log(r).Info("WHEP session created",
 		"session_id", sessionID,
 		"app", appName,
 		"stream", streamName,
@@ -263,72 +455,176 @@ func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request, appName, s
 }
 
 func (s *Server) handleSessionOp(w http.ResponseWriter, r *http.Request, sessionID string) {
+	// Teardown is idempotent: a repeated DELETE, or one racing the reaper,
+	// still succeeds. Remove and Stop are safe on an already-removed session.
+	if r.Method == http.MethodDelete {
+		s.mgr.Remove(sessionID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
 	session, ok := s.mgr.Get(sessionID)
 	if !ok {
-		http.Error(w, "session not found", http.StatusNotFound)
+		writeJSONError(w, http.StatusNotFound, errCodeSessionNotFound, "session not found")
 		return
 	}
 
 	switch r.Method {
+	case http.MethodGet:
+		answer := session.Answer()
+		if answer == "" {
+			writeJSONError(w, http.StatusNotFound, errCodeSessionNotFound, "session has no answer yet")
+			return
+		}
+		w.Header().Set("Content-Type", "application/sdp")
+		w.Header().Set("ETag", session.ETag())
+		_, _ = io.WriteString(w, answer)
 	case http.MethodPatch:
+		// Any PATCH, including an empty keepalive fragment, shows the client is alive
+		session.Touch()
+		if !session.MatchesETag(r.Header.Get("If-Match")) {
+			w.Header().Set("ETag", session.ETag())
+			writeJSONError(w, http.StatusPreconditionFailed, errCodePrecondition, "If-Match does not match the current session ETag")
+			return
+		}
 		// Trickle ICE - add ICE candidate
 		s.handleICECandidate(w, r, session)
-	case http.MethodDelete:
-		s.mgr.Remove(sessionID)
-		w.WriteHeader(http.StatusOK)
 	case http.MethodOptions:
 		s.writeWHEPOptions(w)
 	default:
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, allowSession)
 	}
 }
 
 func (s *Server) handleICECandidate(w http.ResponseWriter, r *http.Request, session *Session) {
 	contentType := r.Header.Get("Content-Type")
 	if !strings.Contains(contentType, "application/trickle-ice-sdpfrag") {
-		http.Error(w, "Content-Type must be application/trickle-ice-sdpfrag", http.StatusUnsupportedMediaType)
+		writeJSONError(w, http.StatusUnsupportedMediaType, errCodeUnsupportedMedia, "Content-Type must be application/trickle-ice-sdpfrag")
 		return
 	}
 
-	body, err := io.ReadAll(io.LimitReader(r.Body, 4*1024))
+	body, err := readBody(r, s.cfg.MaxFragmentSize)
+	if errors.Is(err, errBodyTooLarge) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, errCodePayloadTooLarge, fmt.Sprintf("ICE fragment exceeds %d bytes", s.cfg.MaxFragmentSize))
+		return
+	}
 	if err != nil {
-		http.Error(w, "failed to read body", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "failed to read body")
 		return
 	}
 	defer r.Body.Close()
 
-	candidate, sdpMid := parseICEFragment(string(body))
-	if candidate == "" {
+	if ufrag, pwd := parseICECredentials(string(body)); pwd != "" && session.IsICERestart(ufrag) {
+		s.handleICERestart(w, r, session, ufrag, pwd)
+		return
+	}
+
+	candidates := parseICEFragment(string(body))
+	if len(candidates) == 0 {
+		// A keepalive PATCH still collects candidates from a kept-open Wowza conn
+		if frag := session.CandidateFragment(session.TakeLateCandidates()); frag != "" {
+			w.Header().Set("Content-Type", "application/trickle-ice-sdpfrag")
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(frag))
+			return
+		}
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	if err := session.AddICECandidate(candidate, sdpMid); err != nil {
-		s.logger.Error("failed to add ICE candidate", "error", err)
-		http.Error(w, "failed to add ICE candidate", http.StatusInternalServerError)
+	remote, err := session.AddICECandidate(candidates)
+	var wowzaErr *WowzaError
+	switch {
+	case errors.Is(err, ErrSessionStopped):
+		writeJSONError(w, http.StatusNotFound, errCodeSessionNotFound, "session not found")
+		return
+	case errors.Is(err, errNotNegotiated):
+		s.log(r).Error("failed to add ICE candidate", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "failed to add ICE candidate")
+		return
+	case errors.As(err, &wowzaErr):
+		// Wowza no longer accepts this session's answer; only an ICE restart recovers
+		writeJSONError(w, http.StatusConflict, errCodeICERejected, wowzaErr.Error())
+		return
+	case err != nil:
+		// The candidates are kept, so retrying the PATCH relays them again
+		writeJSONError(w, http.StatusBadGateway, errCodeSignalingFailed, "failed to relay ICE candidates to Wowza")
+		return
+	}
+
+	// Late Wowza candidates go back to the client in the PATCH response body
+	if frag := session.CandidateFragment(remote); frag != "" {
+		w.Header().Set("Content-Type", "application/trickle-ice-sdpfrag")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(frag))
 		return
 	}
 
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func parseICEFragment(frag string) (candidate string, sdpMid *string) {
+func (s *Server) handleICERestart(w http.ResponseWriter, r *http.Request, session *Session, ufrag, pwd string) {
+	frag, err := session.RestartICE(r.Context(), ufrag, pwd)
+	if errors.Is(err, ErrSessionStopped) {
+		writeJSONError(w, http.StatusNotFound, errCodeSessionNotFound, "session not found")
+		return
+	}
+	if err != nil {
+		s.log(r).Error("ICE restart failed", "session_id", session.ID(), "error", err)
+		writeSignalingError(w, err, "ICE restart failed")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/trickle-ice-sdpfrag")
+	w.Header().Set("ETag", session.ETag())
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(frag))
+}
+
+// parseICECredentials returns the ice-ufrag and ice-pwd from an sdpfrag, if present.
+func parseICECredentials(frag string) (ufrag, pwd string) {
+	creds, _ := ExtractCredentials(frag)
+	return creds.IceUfrag, creds.IcePwd
+}
+
+// parseICEFragment returns every candidate in an sdpfrag, each paired with the
+// a=mid most recently listed before it.
+func parseICEFragment(frag string) []ClientCandidate {
 	lines := strings.Split(frag, "\r\n")
 	if len(lines) == 1 {
 		lines = strings.Split(frag, "\n")
 	}
 
+	var candidates []ClientCandidate
+	var sdpMid *string
 	for _, line := range lines {
 		line = strings.TrimSpace(line)
 		if strings.HasPrefix(line, "a=candidate:") {
-			candidate = strings.TrimPrefix(line, "a=")
+			candidates = append(candidates, ClientCandidate{Candidate: strings.TrimPrefix(line, "a="), SDPMid: sdpMid})
 		} else if strings.HasPrefix(line, "a=mid:") {
 			mid := strings.TrimPrefix(line, "a=mid:")
 			sdpMid = &mid
 		}
 	}
 
-	return candidate, sdpMid
+	return candidates
+}
+
+// Allow header values per route.
+const (
+	allowCreate      = "POST, OPTIONS"
+	allowSession     = "GET, PATCH, DELETE, OPTIONS"
+	allowGet         = "GET"
+	allowDrain       = "POST, DELETE"
+	allowReload      = "POST"
+	allowMaintenance = "POST"
+	allowValidate    = "POST"
+)
+
+// methodNotAllowed writes a 405 with the Allow header required by RFC 9110.
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeJSONError(w, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "method not allowed")
 }
 
 func (s *Server) writeWHEPOptions(w http.ResponseWriter) {
@@ -339,36 +635,369 @@ func (s *Server) writeWHEPOptions(w http.ResponseWriter) {
 
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, allowGet)
 		return
 	}
 	resp := map[string]any{
 		"status":          "healthy",
 		"active_sessions": len(s.mgr.ActiveIDs()),
+		"maintenance":     s.mgr.Maintenance(),
 		"timestamp":       time.Now().Unix(),
 		"version":         Version,
 	}
+	status := http.StatusOK
+
+	// Deep checks only apply in static mode; dynamic hosts come from each request
+	if r.URL.Query().Get("deep") == "1" && s.probe != nil {
+		if err := s.probe.Check(r.Context()); err != nil {
+			s.log(r).Warn("Wowza health probe failed", "error", err)
+			resp["status"] = "unhealthy"
+			resp["wowza"] = "unreachable"
+			status = http.StatusServiceUnavailable
+		} else {
+			resp["wowza"] = "reachable"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// createResponse is the JSON form of a created session, for clients that send
+// Accept: application/json. ExpiresAt is the idle deadline if no PATCH arrives.
+type createResponse struct {
+	SDP       string `json:"sdp"`
+	SessionID string `json:"sessionId"`
+	Location  string `json:"location"`
+	ExpiresAt string `json:"expiresAt,omitempty"`
+}
+
+// prefersJSON reports whether accept ranks application/json above application/sdp.
+// Ties, wildcards and a missing header keep the SDP default.
+func prefersJSON(accept string) bool {
+	var sdpQ, jsonQ float64
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(mediaType)) {
+		case "application/json":
+			jsonQ = max(jsonQ, q)
+		case "application/sdp", "application/*", "*/*":
+			sdpQ = max(sdpQ, q)
+		}
+	}
+	return jsonQ > sdpQ
+}
+
+// validateRequest is the body of POST /whep/validate.
+type validateRequest struct {
+	ClientOffer     string              `json:"client_offer"`
+	WowzaOffer      string              `json:"wowza_offer"`
+	WowzaCandidates []WowzaICECandidate `json:"wowza_candidates"`
+	Codec           string              `json:"codec"`
+	Media           string              `json:"media"`
+}
+
+// handleValidate runs the client answer transform on a supplied Wowza offer
+// without contacting Wowza, for checking SDP munging against captured offers.
+func (s *Server) handleValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, allowValidate)
+		return
+	}
+
+	body, err := readBody(r, 2*s.cfg.MaxOfferSize)
+	if errors.Is(err, errBodyTooLarge) {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, errCodePayloadTooLarge, fmt.Sprintf("request exceeds %d bytes", 2*s.cfg.MaxOfferSize))
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "failed to read body")
+		return
+	}
+	defer r.Body.Close()
+
+	var req validateRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "body must be JSON with client_offer and wowza_offer")
+		return
+	}
+	if req.ClientOffer == "" || req.WowzaOffer == "" {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidOffer, "client_offer and wowza_offer are required")
+		return
+	}
+	clientOffer, err := EnsureMids(req.ClientOffer, s.cfg.SynthesizeMids)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidOffer, err.Error())
+		return
+	}
+	req.Codec = strings.ToLower(req.Codec)
+	if req.Codec != "" && !IsSupportedCodec(req.Codec) {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidCodec, "codec must be h264, vp8, vp9, h265 or any")
+		return
+	}
+	req.Media = strings.ToLower(req.Media)
+	if req.Media != "" && req.Media != "audio" && req.Media != "video" {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "media must be audio or video")
+		return
+	}
+
+	answer, err := CreateAnswerForClient(req.WowzaOffer, clientOffer, req.WowzaCandidates, s.cfg.answerOptions(req.Codec, req.Media))
+	if err != nil {
+		writeJSONError(w, http.StatusUnprocessableEntity, errCodeInvalidOffer, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/sdp")
+	_, _ = w.Write([]byte(answer))
+}
+
+// handleDiscovery describes what this gateway accepts so clients can build
+// endpoint URLs without out-of-band configuration.
+func (s *Server) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, allowGet)
+		return
+	}
+
+	type mode struct {
+		Name string `json:"name"`
+		Path string `json:"path"`
+	}
+	var modes []mode
+	if s.cfg.WowzaWSURL != "" {
+		modes = append(modes, mode{Name: "static", Path: s.cfg.RoutePrefix() + "/whep/{codec}/{app}/{stream}"})
+	}
+	modes = append(modes, mode{Name: "dynamic", Path: s.cfg.RoutePrefix() + "/whep/cloud/{codec}/{host}/{app}/{stream}"})
+
+	resp := map[string]any{
+		"codecs":        SupportedCodecs(),
+		"media":         []string{"audio", "video"},
+		"modes":         modes,
+		"auth_required": s.cfg.AuthToken != "",
+		"trickle_ice":   true,
+		"ice_restart":   true,
+		"version":       Version,
+	}
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(resp)
 }
 
 func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, allowGet)
+		return
+	}
+
+	q := r.URL.Query()
+	offset, err := queryCount(q, "offset")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
+		return
+	}
+	limit, err := queryCount(q, "limit")
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, err.Error())
 		return
 	}
+	filter := StatsFilter{App: q.Get("app"), Stream: q.Get("stream"), Offset: offset, Limit: limit}
+
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(s.mgr.Stats())
+	_ = json.NewEncoder(w).Encode(s.mgr.Stats(filter))
+}
+
+// queryCount parses an optional non-negative integer query parameter, 0 when absent.
+func queryCount(q url.Values, name string) (int, error) {
+	v := q.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", name)
+	}
+	return n, nil
+}
+
+// handleSessionStats returns one session's stats. Unlike /stats it needs no
+// token: the session ID is an unguessable UUID only its client knows.
+func (s *Server) handleSessionStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, allowGet)
+		return
+	}
+	session, ok := s.mgr.Get(strings.TrimPrefix(r.URL.Path, "/stats/"))
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, errCodeSessionNotFound, "session not found")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(session.Stats())
+}
+
+// handleDrain stops all sessions. POST drains (with ?reject=1 to also refuse new
+// sessions); DELETE resumes accepting sessions. Requires AuthToken to be configured.
+func (s *Server) handleDrain(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.AuthToken == "" {
+		writeJSONError(w, http.StatusForbidden, errCodeAdminDisabled, "admin endpoints require AUTH_TOKEN")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		reject := r.URL.Query().Get("reject") == "1"
+		stopped := s.mgr.DrainAll(reject)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"stopped":  stopped,
+			"draining": s.mgr.Draining(),
+		})
+	case http.MethodDelete:
+		s.mgr.Undrain()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, allowDrain)
+	}
+}
+
+// handleMaintenance turns maintenance mode on (?on=1) or off (?on=0). Unlike
+// a drain, existing sessions are kept. Requires AuthToken to be configured.
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.AuthToken == "" {
+		writeJSONError(w, http.StatusForbidden, errCodeAdminDisabled, "admin endpoints require AUTH_TOKEN")
+		return
+	}
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, allowMaintenance)
+		return
+	}
+
+	on, err := strconv.ParseBool(r.URL.Query().Get("on"))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, errCodeInvalidRequest, "on must be 1 or 0")
+		return
+	}
+	s.mgr.SetMaintenance(on)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"maintenance":     on,
+		"active_sessions": len(s.mgr.ActiveIDs()),
+	})
+}
+
+// handleReload re-reads ConfigFile and applies its reloadable settings without
+// touching existing sessions. Requires AuthToken to be configured.
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if s.cfg.AuthToken == "" {
+		writeJSONError(w, http.StatusForbidden, errCodeAdminDisabled, "admin endpoints require AUTH_TOKEN")
+		return
+	}
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, allowReload)
+		return
+	}
+
+	changed, err := s.cfg.Reload()
+	switch {
+	case errors.Is(err, ErrNoConfigFile):
+		writeJSONError(w, http.StatusConflict, errCodeNotConfigured, "reload requires CONFIG_FILE")
+		return
+	case errors.Is(err, ErrInvalidConfigFile):
+		s.logger.Warn("config reload rejected", "error", err)
+		writeJSONError(w, http.StatusUnprocessableEntity, errCodeInvalidConfig, err.Error())
+		return
+	case err != nil:
+		s.logger.Error("config reload failed", "error", err)
+		writeJSONError(w, http.StatusInternalServerError, errCodeInternal, err.Error())
+		return
+	}
+
+	s.logger.Info("config reloaded", "changed", changed)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]any{"changed": changed})
+}
+
+// newMux registers every route. The mux is kept in s.routes so withCORS can
+// tell registered paths from unknown ones.
+func (s *Server) newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	if dir := s.cfg.StaticDir; dir != "" {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			s.logger.Warn("static directory not found, /static/ disabled", "dir", dir)
+		} else {
+			mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(dir))))
+		}
+	}
+	mux.Handle("/whep", withGzip(http.HandlerFunc(s.handleDiscovery)))
+	mux.HandleFunc("/whep/", s.handleWHEP)
+	mux.HandleFunc("/whep/cloud/", s.handleWHEPCloud)
+	if s.cfg.Debug {
+		mux.HandleFunc("/whep/validate", s.handleValidate)
+	}
+	mux.Handle("/health", withGzip(http.HandlerFunc(s.handleHealth)))
+	mux.Handle("/stats", withGzip(http.HandlerFunc(s.handleStats)))
+	mux.Handle("/stats/", withGzip(http.HandlerFunc(s.handleSessionStats)))
+	mux.HandleFunc("/admin/drain", s.handleDrain)
+	mux.HandleFunc("/admin/reload", s.handleReload)
+	mux.HandleFunc("/admin/maintenance", s.handleMaintenance)
+	if s.cfg.Metrics {
+		mux.Handle("/metrics", promhttp.Handler()) // Compresses on its own when asked
+	}
+	return mux
+}
+
+// handler wraps s.routes in the middleware chain. Handlers and middleware see
+// paths without BasePath.
+func (s *Server) handler() http.Handler {
+	var handler http.Handler = s.withLogging(s.withCORS(s.withAuth(s.routes)))
+	if prefix := s.cfg.RoutePrefix(); prefix != "" {
+		handler = http.StripPrefix(prefix, handler)
+	}
+	if s.cfg.EnableH2C {
+		// Plain HTTP/1.1 requests pass through unchanged
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	return s.withRecover(handler)
 }
 
 func (s *Server) withCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		w.Header().Set("Access-Control-Expose-Headers", "Location, Link, Accept-Patch")
+		// Admin endpoints are never callable cross-origin
+		if strings.HasPrefix(r.URL.Path, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-		if r.Method == http.MethodOptions {
+		allowOrigin, credentials := s.cfg.CORSOrigin(r.Header.Get("Origin"))
+		if allowOrigin != "*" {
+			w.Header().Add("Vary", "Origin")
+		}
+		if allowOrigin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowOrigin)
+		}
+		if credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match")
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Link, Accept-Patch, ETag, X-Request-ID")
+
+		// A preflight on any registered route succeeds, even for a session that is
+		// already gone, so the DELETE or POST that follows isn't blocked by the
+		// browser. WHEP handlers answer plain OPTIONS probes themselves after
+		// validating the path; other routes get a bare 204, and unknown paths
+		// fall through to 404
+		if r.Method == http.MethodOptions && s.hasRoute(r) &&
+			(isPreflight(r) || !strings.HasPrefix(r.URL.Path, "/whep/")) {
 			w.WriteHeader(http.StatusNoContent)
 			return
 		}
@@ -377,35 +1006,292 @@ func (s *Server) withCORS(next http.Handler) http.Handler {
 	})
 }
 
+// isPreflight reports whether r is a CORS preflight rather than a plain OPTIONS probe.
+func isPreflight(r *http.Request) bool {
+	return r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// hasRoute reports whether r's path matches a registered handler.
+func (s *Server) hasRoute(r *http.Request) bool {
+	if s.routes == nil {
+		return false
+	}
+	_, pattern := s.routes.Handler(r)
+	return pattern != ""
+}
+
+// withAuth requires a bearer token on state-changing requests when AuthToken is set.
+func (s *Server) withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.cfg.AuthToken == "" || r.URL.Path == "/health" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Bulk stats list every tenant's streams, so they need the token even on GET
+		switch {
+		case r.Method == http.MethodPost, r.Method == http.MethodPatch, r.Method == http.MethodDelete:
+		case r.Method == http.MethodGet && r.URL.Path == "/stats":
+		default:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AuthToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="whep"`)
+			writeJSONError(w, http.StatusUnauthorized, errCodeUnauthorized, "unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (s *Server) withLogging(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRe.MatchString(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set("X-Request-ID", id)
+		r = r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+
 		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		// Deferred so a panicking request is still logged on its way out to
+		// withRecover, with the 500 that withRecover is about to send
+		completed := false
+		defer func() {
+			status := sw.status
+			if !completed && !sw.wroteHeader {
+				status = http.StatusInternalServerError
+			}
+			metricResponseBytes.Add(float64(sw.bytes))
+
+			if r.URL.Path == "/health" {
+				return
+			}
+
+			if s.accessLog != nil {
+				_, _ = io.WriteString(s.accessLog, combinedLogLine(s.cfg.ClientIP(r), r, status, sw.bytes, start))
+				return
+			}
+			s.logger.Info("HTTP request",
+				"request_id", id,
+				"method", r.Method,
+				"path", redactPath(r.URL.Path),
+				"status", status,
+				"bytes", sw.bytes,
+				"duration", time.Since(start).String(),
+			)
+		}()
 		next.ServeHTTP(sw, r)
+		completed = true
+	})
+}
+
+// withRecover turns a panic in any handler or middleware into a logged error
+// and a 500, instead of a dropped connection. It wraps every other layer,
+// including StripPrefix and h2c; withLogging writes its access log line while
+// the panic passes through it.
+func (s *Server) withRecover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p) // Deliberate abort; net/http handles it quietly
+			}
+
+			s.logger.Error("panic serving request",
+				"request_id", w.Header().Get("X-Request-ID"),
+				"method", r.Method,
+				"path", redactPath(r.URL.Path),
+				"panic", fmt.Sprint(p),
+				"stack", string(debug.Stack()),
+			)
+			if !sw.wroteHeader {
+				writeJSONError(w, http.StatusInternalServerError, errCodeInternal, "internal server error")
+			}
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// requestIDKey is the context key for the ID assigned by withLogging.
+type requestIDKey struct{}
+
+// requestIDRe bounds client-supplied X-Request-ID values so they can't inject into logs.
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestID returns the request ID stored in ctx, or "" outside a request.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID annotates logger with ctx's request ID, if any.
+func withRequestID(ctx context.Context, logger *slog.Logger) *slog.Logger {
+	if id := requestID(ctx); id != "" {
+		return logger.With("request_id", id)
+	}
+	return logger
+}
+
+// log returns the server logger tagged with r's request ID.
+func (s *Server) log(r *http.Request) *slog.Logger {
+	return withRequestID(r.Context(), s.logger)
+}
 
-		if r.URL.Path == "/health" {
+// iceServerLink formats srv as a WHEP ice-server Link header value.
+func iceServerLink(srv ICEServer) string {
+	link := "<" + srv.URL + `>; rel="ice-server"`
+	if srv.Username != "" || srv.Credential != "" {
+		link += fmt.Sprintf(`; username=%s; credential=%s; credential-type="password"`,
+			quoteParam(srv.Username), quoteParam(srv.Credential))
+	}
+	return link
+}
+
+var paramQuoter = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// quoteParam renders v as an HTTP quoted-string.
+func quoteParam(v string) string {
+	return `"` + paramQuoter.Replace(v) + `"`
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// readBody reads at most limit bytes of r's body. One extra byte is read so a
+// body that would be truncated is reported as errBodyTooLarge.
+func readBody(r *http.Request, limit int) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > limit {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
+
+// redactPath drops anything after an embedded "?" so stream tokens stay out of logs.
+func redactPath(p string) string {
+	base, _, _ := strings.Cut(p, "?")
+	return base
+}
+
+// withGzip compresses responses for clients that accept gzip. It's applied to
+// JSON routes only; SDP responses stay uncompressed since some clients mishandle them.
+func withGzip(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		s.logger.Info("HTTP request",
-			"method", r.Method,
-			"path", r.URL.Path,
-			"status", sw.status,
-			"duration", time.Since(start).String(),
-		)
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length")
+		next.ServeHTTP(&gzipWriter{ResponseWriter: w, gz: gz}, r)
 	})
 }
 
+// acceptsGzip reports whether an Accept-Encoding value allows gzip with a non-zero q.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		q, ok := strings.CutPrefix(strings.TrimSpace(params), "q=")
+		return !ok || strings.Trim(q, "0.") != ""
+	}
+	return false
+}
+
+type gzipWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w *gzipWriter) Write(b []byte) (int, error) {
+	return w.gz.Write(b)
+}
+
+// statusWriter records the status and body size of a response. A Write
+// without WriteHeader is an implicit 200, and later WriteHeader calls are
+// superfluous, so only the first status sent is kept.
 type statusWriter struct {
 	http.ResponseWriter
-	status int
+	status      int
+	bytes       int64 // Body bytes written, after any compression
+	wroteHeader bool
 }
 
 func (w *statusWriter) WriteHeader(code int) {
-	w.status = code
+	if !w.wroteHeader {
+		w.status = code
+		w.wroteHeader = true
+	}
 	w.ResponseWriter.WriteHeader(code)
 }
 
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush passes through to the underlying writer so streamed responses aren't
+// buffered behind the logging middleware, over HTTP/1.1 and h2c alike.
+func (w *statusWriter) Flush() {
+	w.wroteHeader = true
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack passes through to the underlying writer. h2c takes over the
+// connection this way, and checks for http.Hijacker directly rather than
+// through http.ResponseController, so withRecover must not hide it.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", w.ResponseWriter)
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil {
+		w.wroteHeader = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// splitStreamToken separates a "token" parameter embedded in the stream segment
+// (e.g. "stream?token=abc") from the stream name sent to Wowza.
+func splitStreamToken(streamName string) (stream, token string) {
+	stream, query, found := strings.Cut(streamName, "?")
+	if !found {
+		return streamName, ""
+	}
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return stream, ""
+	}
+	return stream, values.Get("token")
+}
+
 // parseAppStream parses "app/stream" from URL path
 func parseAppStream(urlPath string) (appName, streamName string, err error) {
 	parts := strings.Split(urlPath, "/")
@@ -431,6 +1317,11 @@ func parseAppStream(urlPath string) (appName, streamName string, err error) {
 
 var pathSegmentRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
 
+// tokenRe bounds secure tokens to URL-safe and base64 characters. The token only
+// reaches Wowza JSON-encoded in getOffer and never goes into SDP, but rejecting
+// control characters and quotes up front keeps it that way if that changes.
+var tokenRe = regexp.MustCompile(`^[A-Za-z0-9._~+/=-]{1,512}$`)
+
 func validatePathSegment(seg string) error {
 	if seg == "" {
 		return fmt.Errorf("empty segment")
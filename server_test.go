@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const testOffer = "v=0\r\n" +
+	"o=- 1 2 IN IP4 127.0.0.1\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+	"a=mid:0\r\n" +
+	"a=rtpmap:96 H264/90000\r\n"
+
+// newTestServer returns the full middleware chain for a server built on cfg.
+// Its manager is shut down when the test ends.
+func newTestServer(t *testing.T, cfg *Config) (http.Handler, *Manager) {
+	t.Helper()
+	mgr := NewManager(cfg, testLogger())
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = mgr.Shutdown(ctx)
+	})
+	s := NewServer(cfg, mgr, testLogger())
+	s.routes = s.newMux()
+	return s.handler(), mgr
+}
+
+// errorCode returns the code from a JSON error body, or "" if there isn't one.
+func errorCode(rec *httptest.ResponseRecorder) string {
+	var body errorBody
+	_ = json.Unmarshal(rec.Body.Bytes(), &body)
+	return body.Error.Code
+}
+
+func TestAuthRejectsMalformedBearer(t *testing.T) {
+	h, _ := newTestServer(t, &Config{
+		WowzaWSURL: "ws://127.0.0.1:1/webrtc-session.json",
+		AuthToken:  "s3cret",
+	})
+
+	tests := []struct {
+		name   string
+		header string
+		want   int
+	}{
+		{"missing", "", http.StatusUnauthorized},
+		{"empty bearer", "Bearer ", http.StatusUnauthorized},
+		{"scheme only", "Bearer", http.StatusUnauthorized},
+		{"wrong scheme", "Basic s3cret", http.StatusUnauthorized},
+		{"token without scheme", "s3cret", http.StatusUnauthorized},
+		{"overlong", "Bearer s3cret" + strings.Repeat("A", 8192), http.StatusUnauthorized},
+		{"trailing control character", "Bearer s3cret\x00", http.StatusUnauthorized},
+		{"embedded newline", "Bearer s3cret\r\nX-Injected: 1", http.StatusUnauthorized},
+		{"valid", "Bearer s3cret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodDelete, "/whep/h264/live/stream/session-gone", nil)
+			if tt.header != "" {
+				req.Header["Authorization"] = []string{tt.header}
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.want, rec.Body.String())
+			}
+			if tt.want == http.StatusUnauthorized {
+				if code := errorCode(rec); code != errCodeUnauthorized {
+					t.Errorf("error code = %q, want %q", code, errCodeUnauthorized)
+				}
+				if rec.Header().Get("WWW-Authenticate") == "" {
+					t.Error("missing WWW-Authenticate")
+				}
+			}
+		})
+	}
+}
+
+func TestCreateRejectsMalformedSecureToken(t *testing.T) {
+	// A token that passes validation reaches the app check and gets its 403
+	h, _ := newTestServer(t, &Config{
+		WowzaWSURL:   "ws://127.0.0.1:1/webrtc-session.json",
+		AllowedApps:  "other",
+		MaxOfferSize: 1 << 16,
+	})
+
+	tests := []struct {
+		name  string
+		token string // Already query-escaped
+		want  int
+	}{
+		{"overlong", strings.Repeat("a", 513), http.StatusBadRequest},
+		{"NUL", "abc%00def", http.StatusBadRequest},
+		{"CRLF", "abc%0D%0Adef", http.StatusBadRequest},
+		{"quote", "abc%22def", http.StatusBadRequest},
+		{"space", "abc%20def", http.StatusBadRequest},
+		{"angle brackets", "%3Cscript%3E", http.StatusBadRequest},
+		{"longest allowed", strings.Repeat("a", 512), http.StatusForbidden},
+		{"base64", "dGVzdA%3D%3D", http.StatusForbidden},
+		{"url-safe", "abc-_.~123", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/whep/h264/live/stream?token="+tt.token, strings.NewReader(testOffer))
+			req.Header.Set("Content-Type", "application/sdp")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.want, rec.Body.String())
+			}
+			if tt.want == http.StatusBadRequest {
+				if code := errorCode(rec); code != errCodeInvalidRequest {
+					t.Errorf("error code = %q, want %q", code, errCodeInvalidRequest)
+				}
+				if strings.Contains(rec.Body.String(), "def") {
+					t.Errorf("token echoed in response: %s", rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestMethodNotAllowedAllowHeader(t *testing.T) {
+	h, mgr := newTestServer(t, &Config{
+		WowzaWSURL: "ws://127.0.0.1:1/webrtc-session.json",
+		AuthToken:  "s3cret",
+		Debug:      true,
+	})
+	// Session routes only reach the method check for a live session
+	id, _, err := mgr.Create(context.Background(), "live", "stream", "h264", "ws://127.0.0.1:1/webrtc-session.json", "192.0.2.1")
+	if err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	tests := []struct {
+		path  string
+		allow string
+	}{
+		{"/whep/h264/live/stream", allowCreate},
+		{"/whep/cloud/h264/example.com/live/stream", allowCreate},
+		{"/whep/h264/live/stream/" + id, allowSession},
+		{"/whep/cloud/h264/example.com/live/stream/" + id, allowSession},
+		{"/whep", allowGet},
+		{"/whep/validate", allowValidate},
+		{"/health", allowGet},
+		{"/stats", allowGet},
+		{"/stats/" + id, allowGet},
+		{"/admin/drain", allowDrain},
+		{"/admin/reload", allowReload},
+		{"/admin/maintenance", allowMaintenance},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, tt.path, nil))
+
+			if rec.Code != http.StatusMethodNotAllowed {
+				t.Fatalf("status = %d, want 405 (%s)", rec.Code, rec.Body.String())
+			}
+			if got := rec.Header().Get("Allow"); got != tt.allow {
+				t.Errorf("Allow = %q, want %q", got, tt.allow)
+			}
+			if code := errorCode(rec); code != errCodeMethodNotAllowed {
+				t.Errorf("error code = %q, want %q", code, errCodeMethodNotAllowed)
+			}
+		})
+	}
+}
+
+func TestReloadStatus(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	tests := []struct {
+		name string
+		file string
+		want int
+	}{
+		{"valid", write("valid.env", "ALLOWED_HOSTS=*.example.com\n"), http.StatusOK},
+		{"malformed glob", write("glob.env", "ALLOWED_HOSTS=[a-\n"), http.StatusUnprocessableEntity},
+		{"malformed line", write("line.env", "ALLOWED_HOSTS\n"), http.StatusUnprocessableEntity},
+		{"unreadable", filepath.Join(dir, "missing.env"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, _ := newTestServer(t, &Config{AuthToken: "s3cret", ConfigFile: tt.file})
+			req := httptest.NewRequest(http.MethodPost, "/admin/reload", nil)
+			req.Header.Set("Authorization", "Bearer s3cret")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d (%s)", rec.Code, tt.want, rec.Body.String())
+			}
+			if tt.want == http.StatusUnprocessableEntity {
+				if code := errorCode(rec); code != errCodeInvalidConfig {
+					t.Errorf("error code = %q, want %q", code, errCodeInvalidConfig)
+				}
+			}
+		})
+	}
+}
+
+func TestH2CThroughHandler(t *testing.T) {
+	h, _ := newTestServer(t, &Config{EnableH2C: true})
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	t.Run("prior knowledge", func(t *testing.T) {
+		client := &http.Client{Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+		}}
+		resp, err := client.Get(srv.URL + "/health")
+		if err != nil {
+			t.Fatalf("GET /health: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+			t.Errorf("got %s %d, want HTTP/2.0 200", resp.Proto, resp.StatusCode)
+		}
+	})
+
+	t.Run("upgrade", func(t *testing.T) {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		// An empty SETTINGS payload is a valid HTTP2-Settings header
+		_, err = io.WriteString(conn, "GET /health HTTP/1.1\r\n"+
+			"Host: example.com\r\n"+
+			"Connection: Upgrade, HTTP2-Settings\r\n"+
+			"Upgrade: h2c\r\n"+
+			"HTTP2-Settings: \r\n\r\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("read upgrade response: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Errorf("status = %d, want 101", resp.StatusCode)
+		}
+	})
+}
+
+func TestValidateAppliesPlayoutDelay(t *testing.T) {
+	h, _ := newTestServer(t, &Config{
+		Debug:           true,
+		MaxOfferSize:    1 << 16,
+		MaxPlayoutDelay: 100 * time.Millisecond,
+	})
+
+	body, err := json.Marshal(validateRequest{
+		ClientOffer: testClientOffer("actpass", clientSection("video", "0", "H264")+
+			"a=extmap:12 "+playoutDelayURI+"\r\n"),
+		WowzaOffer: testWowzaOffer(wowzaVideoSection("v", "97", "H264")),
+		Codec:      "h264",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/whep/validate", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (%s)", rec.Code, rec.Body.String())
+	}
+	want := "a=extmap:12 " + playoutDelayURI + " min=0;max=100"
+	if !strings.Contains(rec.Body.String(), want+"\r\n") {
+		t.Errorf("answer lacks %q:\n%s", want, rec.Body.String())
+	}
+}
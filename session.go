@@ -2,75 +2,575 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// ErrSessionStopped is returned when operating on a session that has been stopped.
+var ErrSessionStopped = errors.New("session stopped")
+
 // Session bridges WHEP client and Wowza signaling. WebSocket closes after SDP exchange.
 type Session struct {
 	id         string
 	appName    string
 	streamName string
-	wsURL      string
+	codec      string
+	wsURLs     []string // Upstreams tried in order; several only in static mode
+	token      string   // Wowza secureToken; never logged
+	userData   map[string]string
+	media      string // "audio" or "video" for single-media sessions
+	clientIP   string // Set once by Manager.Create
+
+	// negotiations is the manager's semaphore bounding concurrent Wowza
+	// exchanges; nil when MaxConcurrentNegotiations is unlimited
+	negotiations chan struct{}
 
 	cfg    *Config
 	logger *slog.Logger
 
-	wowzaSessionID string
-	createdAt      time.Time
+	// ctx is cancelled by Stop, aborting any in-flight Wowza exchange
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	createdAt time.Time
+
+	mu             sync.Mutex
+	stopped        bool
+	wowzaSessionID string // From the last getOffer; replaced by each ICE restart
+	wsURL          string // Upstream that served the last offer; trickle relays go there
+	lastActivity   time.Time
+	awaitMediaBy   time.Time         // Set on successful negotiation, cleared by Touch; zero when not waiting
+	clientOffer    string            // Last client offer, reused for ICE restarts
+	answerForWowza string            // Last answer sent to Wowza, resent with trickled candidates
+	clientMids     []string          // Client mid per m-line index, for mapping Wowza candidates
+	trickled       []ClientCandidate // Client candidates received via PATCH, not yet relayed
+	answer         string            // Current answer for the client, served on GET of the resource
+	etag           string            // Entity tag of the current answer, for If-Match on PATCH
+	missingMedia   []string          // Media types the client wanted that Wowza doesn't offer
+	onStop         func(*Session)
+	stopOnce       sync.Once
 
-	mu       sync.Mutex
-	stopped  bool
-	onStop   func(string)
-	stopOnce sync.Once
+	// KeepWSOpen: the Wowza conn kept after Negotiate, and candidates received
+	// on it since the client last collected them
+	live           *liveConn
+	lateCandidates []WowzaICECandidate
+
+	// Outcome of the last Negotiate, for Stats
+	negotiateTime   time.Duration
+	wowzaCandidates int
+	candidateKinds  map[string]int // Wowza candidates by "transport/type"
+	lastError       string
 }
 
 // NewSession creates a new signaling-only session.
-func NewSession(id, appName, streamName, wsURL string, cfg *Config, logger *slog.Logger) *Session {
+func NewSession(id, appName, streamName, codec, wsURL string, cfg *Config, logger *slog.Logger) *Session {
+	now := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Session{
-		id:         id,
-		appName:    appName,
-		streamName: streamName,
-		wsURL:      wsURL,
-		cfg:        cfg,
-		logger:     logger.With("session_id", id),
-		createdAt:  time.Now(),
+		id:           id,
+		appName:      appName,
+		streamName:   streamName,
+		codec:        codec,
+		wsURLs:       splitUpstreams(wsURL),
+		cfg:          cfg,
+		logger:       logger.With("session_id", id),
+		createdAt:    now,
+		lastActivity: now,
+		ctx:          ctx,
+		cancel:       cancel,
 	}
 }
 
 func (s *Session) ID() string { return s.id }
 
-func (s *Session) SetStopCallback(fn func(string)) { s.onStop = fn }
+func (s *Session) SetStopCallback(fn func(*Session)) { s.onStop = fn }
+
+// SetSecureToken sets the Wowza secureToken sent with getOffer.
+func (s *Session) SetSecureToken(token string) { s.token = token }
+
+// SetUserData sets the userData forwarded to Wowza with each request.
+func (s *Session) SetUserData(data map[string]string) { s.userData = data }
+
+// SetMedia restricts the session to "audio" or "video"; empty keeps both.
+func (s *Session) SetMedia(media string) { s.media = media }
+
+// Touch records client activity, extending the session's lease and ending
+// the awaiting-media window.
+func (s *Session) Touch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActivity = time.Now()
+	s.awaitMediaBy = time.Time{}
+}
+
+// Expired reports whether the session should be reaped: idle for longer than
+// ttl, or negotiated but never confirmed by a keepalive before its deadline.
+func (s *Session) Expired(now time.Time, ttl time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if ttl > 0 && now.Sub(s.lastActivity) > ttl {
+		return true
+	}
+	return !s.awaitMediaBy.IsZero() && now.After(s.awaitMediaBy)
+}
+
+// LastActivity returns when the session was last active. The reaper uses this
+// rather than createdAt so that activity can extend the session's lease.
+func (s *Session) LastActivity() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastActivity
+}
 
 // Negotiate performs the WHEP signaling exchange with Wowza.
 // Wowza's play protocol is inverted from WHEP: Wowza sends the SDP offer, we send the answer.
 // We bridge this by creating two answers with swapped ICE/DTLS credentials.
-func (s *Session) Negotiate(clientOffer string) (string, error) {
-	timeout := s.cfg.WsTimeout
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+// An exchange Wowza rejects as a session conflict is retried once. Cancelling
+// ctx, e.g. the client dropping the WHEP request, abandons the exchange.
+func (s *Session) Negotiate(ctx context.Context, clientOffer string) (_ string, err error) {
+	release, err := s.acquireNegotiation(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	var trace *sdpTrace
+	if s.cfg.LogSDPOnFailure {
+		trace = &sdpTrace{clientOffer: clientOffer}
+		defer func() {
+			if err != nil {
+				s.logger.Error("negotiation failed", append([]any{"error", err}, trace.attrs()...)...)
+			}
+		}()
+	}
+
+	start := time.Now()
+	defer func() { s.recordNegotiation(time.Since(start), err) }()
+	defer func() {
+		switch {
+		case err == nil:
+		case s.ctx.Err() != nil:
+			err = ErrSessionStopped
+		case ctx.Err() != nil:
+			err = fmt.Errorf("negotiation abandoned: %w", ctx.Err())
+		}
+	}()
+
+	wowzaOffer, answerForWowza, candidates, err := s.exchange(ctx, clientOffer, trace)
+	var wowzaErr *WowzaError
+	if errors.As(err, &wowzaErr) && wowzaErr.SessionConflict() {
+		// A stale Wowza session can linger after an unclean close; getOffer
+		// always yields a fresh sessionId, so one more exchange usually clears it
+		s.logger.Warn("Wowza session conflict, retrying once", "error", err)
+		select {
+		case <-time.After(sessionConflictDelay):
+		case <-s.ctx.Done():
+			return "", err
+		case <-ctx.Done():
+			return "", err
+		}
+		var retryErr error
+		wowzaOffer, answerForWowza, candidates, retryErr = s.exchange(ctx, clientOffer, trace)
+		if retryErr != nil {
+			s.logger.Warn("retry after Wowza session conflict failed", "error", retryErr)
+			return "", err
+		}
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Step 6: Create answer for client with Wowza's ICE/DTLS credentials
+	answerForClient, err := CreateAnswerForClient(wowzaOffer, clientOffer, candidates, s.answerOptions())
+	if trace != nil {
+		trace.answerForClient = answerForClient
+	}
+	if err != nil {
+		signalingFailed(stageAnswer)
+		return "", fmt.Errorf("create answer for client: %w", err)
+	}
+
+	missing := MissingMedia(wowzaOffer, clientOffer, s.answerOptions())
+	if len(missing) > 0 {
+		s.logger.Info("media not available from Wowza, answered as rejected",
+			"app", s.appName,
+			"stream", s.streamName,
+			"missing_media", missing,
+		)
+	}
+
+	var mids []string
+	for _, m := range ExtractMediaOrder(clientOffer) {
+		mids = append(mids, m.Mid)
+	}
+
+	s.mu.Lock()
+	s.clientOffer = clientOffer
+	s.answer = answerForClient
+	s.etag = answerETag(answerForClient)
+	s.missingMedia = missing
+	s.answerForWowza = answerForWowza
+	s.clientMids = mids
+	// Unrelayed candidates were gathered for the previous ICE credentials
+	s.trickled = nil
+	if s.cfg.MediaWait > 0 {
+		s.awaitMediaBy = time.Now().Add(s.cfg.MediaWait)
+	}
+	s.mu.Unlock()
+
+	metricNegotiateDuration.Observe(time.Since(start).Seconds())
+
+	return answerForClient, nil
+}
+
+// sdpTrace buffers the SDP of one negotiation so LogSDPOnFailure can log it
+// when the negotiation fails and drop it otherwise.
+type sdpTrace struct {
+	clientOffer     string
+	wowzaOffer      string
+	answerForWowza  string
+	answerForClient string
+}
+
+// attrs returns the recorded SDP as log attributes, skipping stages the
+// negotiation never reached.
+func (t *sdpTrace) attrs() []any {
+	var attrs []any
+	for _, kv := range [][2]string{
+		{"client_offer", t.clientOffer},
+		{"wowza_offer", t.wowzaOffer},
+		{"answer_for_wowza", t.answerForWowza},
+		{"answer_for_client", t.answerForClient},
+	} {
+		if kv[1] != "" {
+			attrs = append(attrs, kv[0], kv[1])
+		}
+	}
+	return attrs
+}
+
+// exchange runs one getOffer/sendResponse round-trip with Wowza and returns
+// Wowza's offer, the answer sent to Wowza and the candidates Wowza replied with.
+// It ends early when either ctx is done or the session stops. The SDP it sees
+// is recorded in trace when that's non-nil.
+func (s *Session) exchange(ctx context.Context, clientOffer string, trace *sdpTrace) (string, string, []WowzaICECandidate, error) {
+	// WsTimeout caps the whole exchange; each phase below gets its own deadline within it
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.WsTimeout)
 	defer cancel()
+	defer context.AfterFunc(s.ctx, cancel)()
+
+	// Steps 1-2: Request and receive Wowza's offer
+	conn, offerResp, err := s.requestOffer(ctx)
+	if err != nil {
+		return "", "", nil, err
+	}
+	kept := false
+	defer func() {
+		if !kept {
+			conn.Close()
+		}
+	}()
+	// Closing the conn is the only way to unblock a pending read when Stop is
+	// called or the client goes away
+	defer context.AfterFunc(ctx, func() { conn.Close() })()
 
-	dialer := websocket.Dialer{
-		HandshakeTimeout: timeout / 2,
-		TLSClientConfig:  &tls.Config{InsecureSkipVerify: s.cfg.InsecureTLS},
+	// Steps 3-5 run under the candidate phase deadline
+	deadline := phaseDeadline(ctx, conn, s.cfg.candidateTimeout())
+	if interval := s.cfg.WsPingInterval; interval > 0 {
+		stop := startPinger(conn, interval, deadline)
+		defer stop()
 	}
 
-	conn, _, err := dialer.DialContext(ctx, s.wsURL, nil)
+	if offerResp.Status < 200 || offerResp.Status >= 300 {
+		signalingFailed(stageGetOffer)
+		return "", "", nil, &WowzaError{Status: offerResp.Status, Description: offerResp.StatusDescription}
+	}
+
+	if offerResp.SDP == nil || offerResp.SDP.SDP == "" {
+		signalingFailed(stageGetOffer)
+		return "", "", nil, fmt.Errorf("wowza returned empty SDP offer")
+	}
+	if trace != nil {
+		trace.wowzaOffer = offerResp.SDP.SDP
+	}
+	if err := checkWowzaOffer(offerResp.SDP, s.cfg.StrictOfferType); err != nil {
+		signalingFailed(stageGetOffer)
+		return "", "", nil, err
+	}
+	if t := offerResp.SDP.Type; t != "" && t != "offer" {
+		s.logger.Warn("Wowza labelled its offer with the wrong SDP type, using it anyway", "type", t)
+	}
+
+	wowzaSessionID := offerResp.StreamInfo.SessionID
+	s.mu.Lock()
+	s.wowzaSessionID = wowzaSessionID
+	s.mu.Unlock()
+	s.logger.Info("received offer from Wowza", "wowza_session_id", wowzaSessionID)
+
+	// Step 3: Create answer for Wowza with client's ICE/DTLS credentials
+	answerForWowza, err := CreateAnswerForWowza(offerResp.SDP.SDP, clientOffer, s.answerOptions())
+	if trace != nil {
+		trace.answerForWowza = answerForWowza
+	}
 	if err != nil {
-		return "", fmt.Errorf("websocket dial: %w", err)
+		signalingFailed(stageAnswer)
+		return "", "", nil, fmt.Errorf("create answer for wowza: %w", err)
 	}
-	defer conn.Close()
 
-	deadline := time.Now().Add(timeout)
-	conn.SetReadDeadline(deadline)
-	conn.SetWriteDeadline(deadline)
+	// Step 4: Send answer to Wowza
+	sendRespReq := WowzaSendResponseRequest{
+		Direction: "play",
+		Command:   "sendResponse",
+		StreamInfo: WowzaStreamInfo{
+			ApplicationName: s.appName,
+			StreamName:      s.streamName,
+			SessionID:       wowzaSessionID,
+		},
+		SDP:      WowzaSDP{Type: "answer", SDP: answerForWowza},
+		UserData: s.userData,
+	}
+
+	if err := conn.WriteJSON(&sendRespReq); err != nil {
+		signalingFailed(stageSendResponse)
+		return "", "", nil, fmt.Errorf("send sendResponse: %w", err)
+	}
+
+	// Step 5: Receive ICE candidates from Wowza. A kept-open conn gathers the
+	// candidates that follow the reply through its read loop instead.
+	grace := candidateGrace
+	if s.cfg.KeepWSOpen {
+		grace = 0
+	}
+	candidates, err := s.readCandidates(conn, grace)
+	if err != nil {
+		signalingFailed(stageSendResponse)
+		return "", "", nil, err
+	}
+	if s.cfg.KeepWSOpen {
+		kept = true
+		s.attachConn(conn)
+		select {
+		case <-time.After(candidateGrace):
+		case <-ctx.Done():
+		}
+		candidates = append(candidates, s.TakeLateCandidates()...)
+	}
+
+	kinds := candidateKinds(candidates)
+	for kind, n := range kinds {
+		transport, typ, _ := strings.Cut(kind, "/")
+		metricWowzaCandidates.WithLabelValues(transport, typ).Add(float64(n))
+	}
+	s.logger.Info("signaling complete", "ice_candidates", len(candidates), "candidate_types", kinds)
+	s.mu.Lock()
+	s.wowzaCandidates = len(candidates)
+	s.candidateKinds = kinds
+	s.mu.Unlock()
+
+	return offerResp.SDP.SDP, answerForWowza, candidates, nil
+}
+
+// acquireNegotiation waits for a negotiation slot, giving up when ctx is done or
+// after WsTimeout so a queued request can't wait longer than an exchange would.
+func (s *Session) acquireNegotiation(ctx context.Context) (release func(), err error) {
+	if s.negotiations == nil {
+		return func() {}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.WsTimeout)
+	defer cancel()
+
+	select {
+	case s.negotiations <- struct{}{}:
+		return func() { <-s.negotiations }, nil
+	case <-s.ctx.Done():
+		return nil, ErrSessionStopped
+	case <-ctx.Done():
+		return nil, fmt.Errorf("%w: limit %d", ErrNegotiationBusy, cap(s.negotiations))
+	}
+}
+
+// requestOffer dials Wowza and performs the getOffer round-trip, retrying transport
+// failures with exponential backoff until DialRetries or the ctx deadline is exhausted.
+// Nothing has been committed on the Wowza side yet, so a retry can't duplicate a session.
+//
+// Every session needs its own getOffer: each offer belongs to one Wowza peer
+// connection with its own ICE credentials and sessionId, and sendResponse binds
+// that connection to a single client's DTLS fingerprint. Reusing a cached offer
+// for a second client would answer an already-claimed connection, so identical
+// offers to the same stream can't share the round-trip.
+func (s *Session) requestOffer(ctx context.Context) (*websocket.Conn, *WowzaResponse, error) {
+	try := s.tryUpstreams
+	if s.cfg.ParallelUpstreams > 1 && len(s.wsURLs) > 1 {
+		try = s.raceUpstreams
+	}
+
+	backoff := s.cfg.DialBackoff
+	for attempt := 0; ; attempt++ {
+		conn, resp, stage, err := try(ctx)
+		if err == nil {
+			return conn, resp, nil
+		}
+
+		if attempt >= s.cfg.DialRetries || ctx.Err() != nil || errors.Is(err, errSubprotocolMismatch) || errors.Is(err, errWowzaMessageTooLarge) {
+			signalingFailed(stage)
+			return nil, nil, err
+		}
+
+		s.logger.Warn("retrying Wowza getOffer",
+			"attempt", attempt+1,
+			"max_retries", s.cfg.DialRetries,
+			"backoff", backoff.String(),
+			"error", err,
+		)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			signalingFailed(stage)
+			return nil, nil, err
+		}
+		backoff *= 2
+	}
+}
+
+// tryUpstreams tries getOffer against each upstream in order, moving on when
+// one fails to dial, answer or return a 2xx offer. The last upstream's reply is
+// returned whatever its status, so Wowza's own error still reaches the client.
+func (s *Session) tryUpstreams(ctx context.Context) (*websocket.Conn, *WowzaResponse, string, error) {
+	var (
+		stage string
+		err   error
+	)
+	for i, wsURL := range s.wsURLs {
+		var conn *websocket.Conn
+		var resp *WowzaResponse
+		conn, resp, stage, err = s.tryGetOffer(ctx, wsURL)
+		last := i == len(s.wsURLs)-1
+		if err == nil && (last || resp.Status >= 200 && resp.Status < 300) {
+			s.mu.Lock()
+			s.wsURL = wsURL
+			s.mu.Unlock()
+			return conn, resp, "", nil
+		}
+		if err == nil {
+			conn.Close()
+			stage, err = stageGetOffer, &WowzaError{Status: resp.Status, Description: resp.StatusDescription}
+		}
+		if last || ctx.Err() != nil {
+			break
+		}
+		s.logger.Warn("Wowza upstream failed, trying next", "upstream", wsURL, "error", err)
+	}
+	return nil, nil, stage, err
+}
+
+// raceUpstreams runs getOffer against up to ParallelUpstreams upstreams at once,
+// starting the next in order whenever one fails, and returns the first 2xx
+// offer. The others are cancelled and their connections closed as they finish.
+// If none succeeds, the last upstream's reply or error is returned, as in
+// tryUpstreams.
+func (s *Session) raceUpstreams(ctx context.Context) (*websocket.Conn, *WowzaResponse, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type attempt struct {
+		index int
+		conn  *websocket.Conn
+		resp  *WowzaResponse
+		stage string
+		err   error
+	}
+	results := make(chan attempt, len(s.wsURLs))
+	next, running := 0, 0
+	launch := func() {
+		i := next
+		next++
+		running++
+		go func() {
+			conn, resp, stage, err := s.tryGetOffer(ctx, s.wsURLs[i])
+			results <- attempt{index: i, conn: conn, resp: resp, stage: stage, err: err}
+		}()
+	}
+	for running < s.cfg.ParallelUpstreams && next < len(s.wsURLs) {
+		launch()
+	}
+
+	var (
+		tail  *attempt // Non-2xx reply from the last upstream, passed through like tryUpstreams does
+		stage string
+		err   error
+	)
+	for running > 0 {
+		a := <-results
+		running--
+		wsURL := s.wsURLs[a.index]
+
+		if a.err == nil && a.resp.Status >= 200 && a.resp.Status < 300 {
+			s.mu.Lock()
+			s.wsURL = wsURL
+			s.mu.Unlock()
+			if tail != nil {
+				closeGracefully(tail.conn)
+			}
+			go func(pending int) {
+				for range pending {
+					if loser := <-results; loser.conn != nil {
+						closeGracefully(loser.conn)
+					}
+				}
+			}(running)
+			return a.conn, a.resp, "", nil
+		}
+
+		stage, err = a.stage, a.err
+		if err == nil {
+			stage, err = stageGetOffer, &WowzaError{Status: a.resp.Status, Description: a.resp.StatusDescription}
+			if a.index == len(s.wsURLs)-1 {
+				tail = &a
+			} else {
+				closeGracefully(a.conn)
+			}
+		}
+		if ctx.Err() != nil {
+			continue
+		}
+		s.logger.Warn("Wowza upstream failed", "upstream", wsURL, "error", err)
+		if next < len(s.wsURLs) {
+			launch()
+		}
+	}
+
+	if tail != nil {
+		s.mu.Lock()
+		s.wsURL = s.wsURLs[tail.index]
+		s.mu.Unlock()
+		return tail.conn, tail.resp, "", nil
+	}
+	return nil, nil, stage, err
+}
+
+// tryGetOffer makes a single dial and getOffer attempt, reporting which stage failed.
+func (s *Session) tryGetOffer(ctx context.Context, wsURL string) (*websocket.Conn, *WowzaResponse, string, error) {
+	conn, err := s.dial(ctx, wsURL)
+	if err != nil {
+		return nil, nil, stageDial, err
+	}
+	phaseDeadline(ctx, conn, s.cfg.offerTimeout())
+	// Cancelling ctx, e.g. when another upstream wins a race, interrupts the read
+	defer context.AfterFunc(ctx, func() { closeGracefully(conn) })()
 
-	// Step 1: Request offer from Wowza
 	getOfferReq := WowzaGetOfferRequest{
 		Direction: "play",
 		Command:   "getOffer",
@@ -78,76 +578,276 @@ func (s *Session) Negotiate(clientOffer string) (string, error) {
 			ApplicationName: s.appName,
 			StreamName:      s.streamName,
 		},
+		UserData: s.userData,
+	}
+	if s.token != "" {
+		getOfferReq.SecureToken = &s.token
 	}
 
 	if err := conn.WriteJSON(&getOfferReq); err != nil {
-		return "", fmt.Errorf("send getOffer: %w", err)
+		conn.Close()
+		return nil, nil, stageGetOffer, fmt.Errorf("send getOffer: %w", err)
 	}
 
-	// Step 2: Receive Wowza's offer
 	var offerResp WowzaResponse
-	if err := conn.ReadJSON(&offerResp); err != nil {
-		return "", fmt.Errorf("read getOffer response: %w", err)
+	if err := readWowzaJSON(conn, &offerResp); err != nil {
+		conn.Close()
+		return nil, nil, stageGetOffer, fmt.Errorf("read getOffer response: %w", err)
 	}
 
-	if offerResp.Status < 200 || offerResp.Status >= 300 {
-		return "", fmt.Errorf("wowza error: %s", offerResp.StatusDescription)
+	return conn, &offerResp, "", nil
+}
+
+func (s *Session) answerOptions() AnswerOptions {
+	return s.cfg.answerOptions(s.codec, s.media)
+}
+
+// dial opens the signaling websocket to wsURL within DialTimeout.
+func (s *Session) dial(ctx context.Context, wsURL string) (*websocket.Conn, error) {
+	if s.logger.Enabled(ctx, slog.LevelDebug) {
+		s.logger.Debug("dialing Wowza", "url", wsURL, "headers", redactHeader(s.cfg.WowzaDialHeader()))
+	}
+	conn, resp, err := dialWowza(ctx, s.cfg, wsURL, s.cfg.dialTimeout())
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.WowzaCompression {
+		s.logger.Debug("Wowza WebSocket connected", "compression", compressionNegotiated(resp))
 	}
+	return conn, nil
+}
 
-	if offerResp.SDP == nil || offerResp.SDP.SDP == "" {
-		return "", fmt.Errorf("wowza returned empty SDP offer")
+// ClientCandidate is one a=candidate line from a client's trickle-ice-sdpfrag,
+// with the mid of the m-section it was listed under (nil if none preceded it).
+type ClientCandidate struct {
+	Candidate string
+	SDPMid    *string
+}
+
+// errNotNegotiated is returned by AddICECandidate before Negotiate has succeeded.
+var errNotNegotiated = errors.New("session not negotiated")
+
+// AddICECandidate stores trickled client candidates and relays every candidate
+// received so far to Wowza, returning any new candidates Wowza sends back.
+//
+// The signaling websocket is closed once Negotiate returns, so relaying opens a
+// fresh connection and resends the answer under the existing Wowza session ID.
+// If the relay fails the candidates stay stored and the error is returned; a
+// later PATCH relays them again along with its own. A *WowzaError means Wowza
+// rejected the answer, usually because it has discarded the session, and the
+// client has to restart ICE. Candidates still pending when Negotiate runs again
+// belong to the old ICE credentials and are dropped.
+//
+// Pending candidates are taken off s.trickled before relaying, so an
+// overlapping PATCH only relays its own; a failed relay puts its batch back.
+func (s *Session) AddICECandidate(candidates []ClientCandidate) ([]WowzaICECandidate, error) {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return nil, ErrSessionStopped
 	}
+	if s.answerForWowza == "" {
+		s.mu.Unlock()
+		return nil, errNotNegotiated
+	}
+	batch := append(s.trickled, candidates...)
+	s.trickled = nil
+	lines := candidateLines(batch)
+	answer := appendCandidates(s.answerForWowza, lines, s.cfg.FilterIPv6)
+	upstream, wowzaSessionID := s.wsURL, s.wowzaSessionID
+	s.mu.Unlock()
 
-	s.wowzaSessionID = offerResp.StreamInfo.SessionID
-	s.logger.Info("received offer from Wowza", "wowza_session_id", s.wowzaSessionID)
+	relayed := false
+	defer func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if relayed {
+			// Merge rather than overwrite, keeping what an overlapping PATCH relayed
+			s.answerForWowza = appendCandidates(s.answerForWowza, lines, s.cfg.FilterIPv6)
+		} else {
+			s.trickled = append(batch, s.trickled...)
+		}
+	}()
 
-	// Step 3: Create answer for Wowza with client's ICE/DTLS credentials
-	answerForWowza, err := CreateAnswerForWowza(offerResp.SDP.SDP, clientOffer)
-	if err != nil {
-		return "", fmt.Errorf("create answer for wowza: %w", err)
+	if s.logger.Enabled(context.Background(), slog.LevelDebug) {
+		for _, c := range candidates {
+			mid := ""
+			if c.SDPMid != nil {
+				mid = *c.SDPMid
+			}
+			s.logger.Debug("relaying trickle ICE candidate", "candidate", c.Candidate, "mid", mid)
+		}
 	}
 
-	// Step 4: Send answer to Wowza
-	sendRespReq := WowzaSendResponseRequest{
+	req := WowzaSendResponseRequest{
 		Direction: "play",
 		Command:   "sendResponse",
 		StreamInfo: WowzaStreamInfo{
 			ApplicationName: s.appName,
 			StreamName:      s.streamName,
-			SessionID:       s.wowzaSessionID,
+			SessionID:       wowzaSessionID,
 		},
-		SDP: WowzaSDP{Type: "answer", SDP: answerForWowza},
+		SDP:      WowzaSDP{Type: "answer", SDP: answer},
+		UserData: s.userData,
 	}
 
-	if err := conn.WriteJSON(&sendRespReq); err != nil {
-		return "", fmt.Errorf("send sendResponse: %w", err)
+	if s.sendLive(&req) {
+		relayed = true
+		select {
+		case <-time.After(candidateGrace):
+		case <-s.ctx.Done():
+			return nil, ErrSessionStopped
+		}
+		return s.TakeLateCandidates(), nil
 	}
 
-	// Step 5: Receive ICE candidates from Wowza
-	var candidatesResp WowzaResponse
-	if err := conn.ReadJSON(&candidatesResp); err != nil {
-		return "", fmt.Errorf("read sendResponse response: %w", err)
-	}
+	ctx, cancel := context.WithTimeout(s.ctx, s.cfg.WsTimeout)
+	defer cancel()
 
-	if candidatesResp.Status < 200 || candidatesResp.Status >= 300 {
-		return "", fmt.Errorf("wowza error: %s", candidatesResp.StatusDescription)
+	conn, err := s.dial(ctx, upstream)
+	if err != nil {
+		s.logger.Warn("trickle relay failed, candidates kept for next PATCH", "error", err)
+		return nil, fmt.Errorf("dial Wowza: %w", err)
 	}
+	phaseDeadline(ctx, conn, s.cfg.candidateTimeout())
+	defer conn.Close()
+	defer context.AfterFunc(s.ctx, func() { conn.Close() })()
 
-	s.logger.Info("signaling complete", "ice_candidates", len(candidatesResp.ICECandidates))
+	if err := conn.WriteJSON(&req); err != nil {
+		s.logger.Warn("trickle relay failed, candidates kept for next PATCH", "error", err)
+		return nil, fmt.Errorf("send sendResponse: %w", err)
+	}
 
-	// Step 6: Create answer for client with Wowza's ICE/DTLS credentials
-	answerForClient, err := CreateAnswerForClient(offerResp.SDP.SDP, clientOffer, candidatesResp.ICECandidates)
+	remote, err := s.readCandidates(conn, candidateGrace)
+	var wowzaErr *WowzaError
+	if errors.As(err, &wowzaErr) {
+		s.logger.Warn("trickle relay rejected by Wowza", "status", wowzaErr.Status, "description", wowzaErr.Description)
+		return nil, err
+	}
 	if err != nil {
-		return "", fmt.Errorf("create answer for client: %w", err)
+		s.logger.Warn("trickle relay failed, candidates kept for next PATCH", "error", err)
+		return nil, err
 	}
 
-	return answerForClient, nil
+	relayed = true
+	return remote, nil
+}
+
+// candidateLines returns the candidate attribute values of cs. Every m-section
+// of the answer shares one BUNDLE transport, so appendCandidates gives each
+// section the full set regardless of mid.
+func candidateLines(cs []ClientCandidate) []string {
+	lines := make([]string, len(cs))
+	for i, c := range cs {
+		lines[i] = c.Candidate
+	}
+	return lines
+}
+
+// candidateGrace is how long readCandidates keeps listening for further
+// candidate messages once Wowza has answered sendResponse.
+const candidateGrace = 250 * time.Millisecond
+
+// readCandidates reads Wowza's reply to sendResponse. Wowza can interleave
+// messages for other commands and split candidates across several messages, so
+// this reads until the sendResponse reply arrives, then gathers any further
+// candidates that follow within grace. A zero grace returns on the reply.
+func (s *Session) readCandidates(conn *websocket.Conn, grace time.Duration) ([]WowzaICECandidate, error) {
+	var candidates []WowzaICECandidate
+	acked := false
+	for {
+		var msg WowzaResponse
+		if err := readWowzaJSON(conn, &msg); err != nil {
+			var netErr net.Error
+			if acked && errors.As(err, &netErr) && netErr.Timeout() {
+				return candidates, nil
+			}
+			return nil, fmt.Errorf("read sendResponse response: %w", err)
+		}
+
+		if msg.Command != "" && msg.Command != "sendResponse" {
+			s.logger.Debug("ignoring Wowza message", "command", msg.Command, "status", msg.Status)
+			continue
+		}
+		// Follow-up candidate messages may omit status; the first reply may not
+		if (msg.Status < 200 || msg.Status >= 300) && !(acked && msg.Status == 0) {
+			return nil, &WowzaError{Status: msg.Status, Description: msg.StatusDescription}
+		}
+
+		candidates = append(candidates, msg.ICECandidates...)
+		if !acked {
+			acked = true
+			// Pongs must not push the deadline past the grace window
+			conn.SetPongHandler(nil)
+			if grace == 0 {
+				return candidates, nil
+			}
+			conn.SetReadDeadline(time.Now().Add(grace))
+		}
+	}
+}
+
+// IsICERestart reports whether ufrag differs from the client's current ICE ufrag.
+func (s *Session) IsICERestart(ufrag string) bool {
+	s.mu.Lock()
+	offer := s.clientOffer
+	s.mu.Unlock()
+
+	if offer == "" || ufrag == "" {
+		return false
+	}
+	creds, _ := ExtractCredentials(offer)
+	return creds.IceUfrag != ufrag
+}
+
+// RestartICE re-runs the Wowza exchange using the client's new ICE credentials and
+// returns an sdpfrag with Wowza's new credentials and candidates. In signaling-only
+// mode Wowza can't restart ICE on an existing session, so this creates a new Wowza
+// session; the previous one is abandoned and expires on Wowza's side.
+func (s *Session) RestartICE(ctx context.Context, ufrag, pwd string) (string, error) {
+	s.mu.Lock()
+	if s.stopped {
+		s.mu.Unlock()
+		return "", ErrSessionStopped
+	}
+	offer, previous := s.clientOffer, s.wowzaSessionID
+	s.mu.Unlock()
+
+	s.logger.Info("ICE restart requested", "previous_wowza_session_id", previous)
+
+	answer, err := s.Negotiate(ctx, replaceICECredentials(offer, ufrag, pwd))
+	if err != nil {
+		return "", err
+	}
+	return iceRestartFragment(answer), nil
 }
 
-// AddICECandidate is a no-op; all candidates are in the initial SDP exchange.
-func (s *Session) AddICECandidate(candidate string, sdpMid *string) error {
-	s.logger.Debug("ignoring trickle ICE candidate", "candidate", candidate)
-	return nil
+// CandidateFragment renders Wowza candidates as a trickle-ice-sdpfrag body,
+// mapping each candidate to the client's mid for its m-line.
+func (s *Session) CandidateFragment(candidates []WowzaICECandidate) string {
+	s.mu.Lock()
+	mids := s.clientMids
+	s.mu.Unlock()
+	ips := s.cfg.CandidateIPs()
+
+	var b strings.Builder
+	for _, c := range candidates {
+		cleaned := mapCandidateIP(cleanWowzaCandidate(c.Candidate), ips)
+		if s.cfg.RelayOnly && candidateType(cleaned) != "relay" {
+			continue
+		}
+		if s.cfg.ReorderCandidates {
+			cleaned = reprioritizeCandidate(cleaned)
+		}
+		switch {
+		case c.SDPMLineIndex != nil && int(*c.SDPMLineIndex) < len(mids):
+			b.WriteString("a=mid:" + mids[*c.SDPMLineIndex] + "\r\n")
+		case c.SDPMid != nil && slices.Contains(mids, *c.SDPMid):
+			b.WriteString("a=mid:" + *c.SDPMid + "\r\n")
+		}
+		b.WriteString("a=" + cleaned + "\r\n")
+	}
+	return b.String()
 }
 
 // Stop marks the session as stopped and triggers cleanup callback.
@@ -156,20 +856,91 @@ func (s *Session) Stop() {
 		s.mu.Lock()
 		s.stopped = true
 		s.mu.Unlock()
+		s.cancel()
 
 		if s.onStop != nil {
-			s.onStop(s.id)
+			s.onStop(s)
 		}
 	})
 }
 
 func (s *Session) Stats() map[string]any {
+	s.mu.Lock()
+	negotiateTime, candidates, kinds, lastError := s.negotiateTime, s.wowzaCandidates, s.candidateKinds, s.lastError
+	missing, upstream, wowzaSessionID := s.missingMedia, s.wsURL, s.wowzaSessionID
+	wsOpen := s.live != nil
+	s.mu.Unlock()
+	if missing == nil {
+		missing = []string{}
+	}
+	if kinds == nil {
+		kinds = map[string]int{}
+	}
+
 	return map[string]any{
 		"id":               s.id,
 		"app":              s.appName,
 		"stream":           s.streamName,
-		"wowza_session_id": s.wowzaSessionID,
+		"codec":            s.codec,
+		"client_ip":        s.clientIP,
+		"wowza_session_id": wowzaSessionID,
+		"upstream":         upstream,
+		"ws_open":          wsOpen,
 		"created_at":       s.createdAt.Unix(),
+		"last_activity":    s.LastActivity().Unix(),
 		"age_secs":         int(time.Since(s.createdAt).Seconds()),
+		"negotiate_ms":     negotiateTime.Milliseconds(),
+		"wowza_candidates": candidates,
+		"candidate_types":  kinds,
+		"last_error":       lastError,
+		"missing_media":    missing,
+	}
+}
+
+// Answer returns the client answer from the last successful negotiation, or ""
+// before the first one.
+func (s *Session) Answer() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.answer
+}
+
+// ETag returns the quoted entity tag of the session's current answer, which
+// changes on every successful negotiation including ICE restarts.
+func (s *Session) ETag() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.etag
+}
+
+// MatchesETag reports whether an If-Match header value allows modifying the
+// session. An absent header or "*" always matches.
+func (s *Session) MatchesETag(ifMatch string) bool {
+	if ifMatch == "" {
+		return true
+	}
+	current := s.ETag()
+	for _, tag := range strings.Split(ifMatch, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == current {
+			return true
+		}
+	}
+	return false
+}
+
+func answerETag(answer string) string {
+	sum := sha256.Sum256([]byte(answer))
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// recordNegotiation stores the duration and error of a Negotiate call for Stats.
+func (s *Session) recordNegotiation(d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.negotiateTime = d
+	s.lastError = ""
+	if err != nil {
+		s.lastError = err.Error()
 	}
 }
@@ -2,11 +2,13 @@
  * WHEP Player with Wowza SDP Munging
  *
  * This player handles the payload type (PT) mismatch between browsers and Wowza.
- * Wowza uses PT 97 for video (both H264 and VP8) and PT 96 for OPUS audio.
+ * Wowza uses PT 97 for video (H264, VP8, VP9 or H265) and PT 96 for OPUS audio.
  *
  * The URL format determines which codec to expect:
  *   /whep/h264/{app}/{stream} - expect H264 at PT 97
  *   /whep/vp8/{app}/{stream}  - expect VP8 at PT 97
+ *   /whep/vp9/{app}/{stream}  - expect VP9 at PT 97
+ *   /whep/h265/{app}/{stream} - expect H265 at PT 97
  *
  * The mungeOfferForWowzaPTs function rewrites the browser's SDP offer to include
  * Wowza's expected payload types BEFORE setLocalDescription() is called.
@@ -164,7 +166,7 @@ function updateStats() {
 /**
  * Extract video codec from WHEP URL path.
  * URL format: /whep/{codec}/{app}/{stream} or /whep/cloud/{codec}/{host}/{app}/{stream}
- * Returns 'h264' or 'vp8', defaults to 'h264' if not found.
+ * Returns 'h264', 'vp8', 'vp9' or 'h265', defaults to 'h264' if not found.
  */
 function extractCodecFromUrl(url) {
     try {
@@ -172,10 +174,10 @@ function extractCodecFromUrl(url) {
         const path = urlObj.pathname;
 
         // Match /whep/cloud/{codec}/... or /whep/{codec}/...
-        const cloudMatch = path.match(/\/whep\/cloud\/(h264|vp8)\//i);
+        const cloudMatch = path.match(/\/whep\/cloud\/(h264|vp8|vp9|h265)\//i);
         if (cloudMatch) return cloudMatch[1].toLowerCase();
 
-        const directMatch = path.match(/\/whep\/(h264|vp8)\//i);
+        const directMatch = path.match(/\/whep\/(h264|vp8|vp9|h265)\//i);
         if (directMatch) return directMatch[1].toLowerCase();
 
         log('No codec in URL, defaulting to h264', 'warn');
@@ -188,7 +190,7 @@ function extractCodecFromUrl(url) {
 /**
  * Munge SDP to match Wowza's fixed payload type scheme.
  *
- * Wowza uses: PT 97 for video (H264 or VP8), PT 96 for OPUS audio.
+ * Wowza uses: PT 97 for video (H264, VP8, VP9 or H265), PT 96 for OPUS audio.
  * This function strips all existing codecs and adds only PT 97 video + PT 96 audio.
  *
  * CRITICAL: Must happen BEFORE setLocalDescription() - browser's internal PT
@@ -270,6 +272,12 @@ function mungeOfferForWowzaPTs(sdp, codec) {
             if (codec === 'vp8') {
                 result.push('a=rtpmap:97 VP8/90000');
                 result.push('a=fmtp:97 max-fs=12288;max-fr=60');
+            } else if (codec === 'vp9') {
+                result.push('a=rtpmap:97 VP9/90000');
+                result.push('a=fmtp:97 profile-id=0');
+            } else if (codec === 'h265') {
+                result.push('a=rtpmap:97 H265/90000');
+                result.push('a=fmtp:97 level-id=93;profile-id=1;tier-flag=0;tx-mode=SRST');
             } else {
                 result.push('a=rtpmap:97 H264/90000');
                 result.push('a=fmtp:97 level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f');
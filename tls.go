@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// certReloader serves the configured certificate and re-reads it from disk on
+// SIGHUP, so renewed certificates are picked up without dropping sessions.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("load TLS certificate: %w", err)
+	}
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// watch reloads the certificate on every SIGHUP until ctx is done. A failed
+// reload keeps the previous certificate in service.
+func (c *certReloader) watch(ctx context.Context, logger *slog.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := c.load(); err != nil {
+				logger.Error("TLS certificate reload failed", "error", err)
+				continue
+			}
+			logger.Info("TLS certificate reloaded", "cert", c.certFile)
+		}
+	}
+}
+
+// tlsVersion maps a TLS_MIN_VERSION value to its crypto/tls constant.
+func tlsVersion(v string) (uint16, error) {
+	switch v {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unsupported TLS min version %q (want 1.2 or 1.3)", v)
+	}
+}
+
+// tlsConfig builds the server TLS config when TLSCert and TLSKey are set. It
+// returns nil for plain HTTP.
+func (s *Server) tlsConfig(ctx context.Context) (*tls.Config, error) {
+	if s.cfg.TLSCert == "" && s.cfg.TLSKey == "" {
+		return nil, nil
+	}
+	if s.cfg.TLSCert == "" || s.cfg.TLSKey == "" {
+		return nil, fmt.Errorf("both TLS certificate and key must be set")
+	}
+
+	minVersion, err := tlsVersion(s.cfg.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := newCertReloader(s.cfg.TLSCert, s.cfg.TLSKey)
+	if err != nil {
+		return nil, err
+	}
+	go certs.watch(ctx, s.logger)
+
+	return &tls.Config{
+		MinVersion:     minVersion,
+		GetCertificate: certs.GetCertificate,
+	}, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Session lifecycle event names sent to WebhookURL.
+const (
+	eventSessionCreated = "session.created"
+	eventSessionStopped = "session.stopped"
+)
+
+const (
+	webhookQueueSize = 256
+	webhookTimeout   = 5 * time.Second
+)
+
+// WebhookEvent is the JSON payload POSTed to WebhookURL.
+type WebhookEvent struct {
+	Event     string `json:"event"`
+	SessionID string `json:"session_id"`
+	App       string `json:"app"`
+	Stream    string `json:"stream"`
+	ClientIP  string `json:"client_ip,omitempty"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// webhookNotifier delivers events from a bounded queue on a single goroutine so
+// that a slow receiver never blocks signaling. Events that don't fit are dropped.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+	logger *slog.Logger
+
+	mu      sync.RWMutex // guards closed against sends on a closed queue
+	closed  bool
+	queue   chan WebhookEvent
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+func newWebhookNotifier(url string, logger *slog.Logger) *webhookNotifier {
+	n := &webhookNotifier{
+		url:    url,
+		client: &http.Client{Timeout: webhookTimeout},
+		logger: logger.With("component", "webhook"),
+		queue:  make(chan WebhookEvent, webhookQueueSize),
+		done:   make(chan struct{}),
+	}
+	go n.run()
+	return n
+}
+
+// Notify enqueues an event without blocking.
+func (n *webhookNotifier) Notify(event string, sess *Session) {
+	ev := WebhookEvent{
+		Event:     event,
+		SessionID: sess.id,
+		App:       sess.appName,
+		Stream:    sess.streamName,
+		ClientIP:  sess.clientIP,
+		Timestamp: time.Now().Unix(),
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.closed {
+		return
+	}
+
+	select {
+	case n.queue <- ev:
+	default:
+		dropped := n.dropped.Add(1)
+		metricWebhookDropped.Inc()
+		n.logger.Warn("webhook queue full, event dropped", "event", event, "session_id", sess.id, "dropped_total", dropped)
+	}
+}
+
+// Close stops accepting events and waits for queued ones to be sent, up to ctx.
+func (n *webhookNotifier) Close(ctx context.Context) error {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.mu.Unlock()
+
+	select {
+	case <-n.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (n *webhookNotifier) run() {
+	defer close(n.done)
+	for ev := range n.queue {
+		if err := n.send(ev); err != nil {
+			n.logger.Warn("webhook delivery failed", "event", ev.Event, "session_id", ev.SessionID, "error", err)
+		}
+	}
+}
+
+func (n *webhookNotifier) send(ev WebhookEvent) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("marshal event: %w", err)
+	}
+
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -1,6 +1,23 @@
 package main
 
-import "strings"
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/sdp/v3"
+)
 
 // WowzaGetOfferRequest asks Wowza to send its SDP offer for playback
 type WowzaGetOfferRequest struct {
@@ -44,11 +61,212 @@ type WowzaResponse struct {
 	ICECandidates     []WowzaICECandidate `json:"iceCandidates,omitempty"`
 }
 
+// WowzaError is a non-2xx status Wowza reported in a signaling response.
+type WowzaError struct {
+	Status      int
+	Description string
+}
+
+func (e *WowzaError) Error() string {
+	return fmt.Sprintf("wowza error: %s", e.Description)
+}
+
+// sessionConflictDelay is how long Negotiate waits before retrying an exchange
+// that failed because Wowza still holds a stale session.
+const sessionConflictDelay = 500 * time.Millisecond
+
+// SessionConflict reports whether Wowza rejected sendResponse because a session
+// with the same identity already exists.
+func (e *WowzaError) SessionConflict() bool {
+	desc := strings.ToLower(e.Description)
+	return e.Status == http.StatusConflict ||
+		strings.Contains(desc, "already exists") ||
+		strings.Contains(desc, "session exists")
+}
+
+// HTTPStatus maps the Wowza condition to the status returned to the WHEP client:
+// 404 for a stream that isn't published, 401/403 for rejected credentials or
+// tokens, and 502 for anything else. Wowza's numeric status isn't consistent
+// across versions, so the description is checked too.
+func (e *WowzaError) HTTPStatus() int {
+	desc := strings.ToLower(e.Description)
+	switch {
+	case e.Status == http.StatusNotFound,
+		strings.Contains(desc, "not found"),
+		strings.Contains(desc, "not published"):
+		return http.StatusNotFound
+	case e.Status == http.StatusUnauthorized,
+		strings.Contains(desc, "unauthorized"),
+		strings.Contains(desc, "authentication"):
+		return http.StatusUnauthorized
+	case e.Status == http.StatusForbidden,
+		strings.Contains(desc, "forbidden"),
+		strings.Contains(desc, "denied"),
+		strings.Contains(desc, "token"):
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
 type WowzaSDP struct {
 	SDP  string `json:"sdp"`
 	Type string `json:"type,omitempty"`
 }
 
+// checkWowzaOffer rejects a getOffer SDP that doesn't parse or has no media
+// sections. Some Wowza builds label the offer "answer"; that only fails with
+// strict, since the content is what the answers are built from.
+func checkWowzaOffer(offer *WowzaSDP, strict bool) error {
+	if strict && offer.Type != "offer" {
+		return fmt.Errorf("wowza returned SDP of type %q, want offer", offer.Type)
+	}
+	var desc sdp.SessionDescription
+	if err := desc.Unmarshal([]byte(offer.SDP)); err != nil {
+		return fmt.Errorf("wowza returned invalid SDP offer: %w", err)
+	}
+	if len(desc.MediaDescriptions) == 0 {
+		return fmt.Errorf("wowza returned SDP offer without media sections")
+	}
+	return nil
+}
+
+// errSubprotocolMismatch means Wowza didn't accept WowzaSubprotocol. It's a
+// configuration problem, so dials failing with it aren't retried.
+var errSubprotocolMismatch = errors.New("wowza negotiated a different subprotocol")
+
+// dialWowza opens a signaling websocket to wsURL, allowing timeout for the
+// handshake, with read/write deadlines set from ctx, or timeout from now if ctx
+// has no deadline. The handshake response is returned alongside the conn.
+func dialWowza(ctx context.Context, cfg *Config, wsURL string, timeout time.Duration) (*websocket.Conn, *http.Response, error) {
+	dialer := websocket.Dialer{
+		HandshakeTimeout: timeout,
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: cfg.InsecureTLS},
+		// Only offered: a Wowza that doesn't accept it is spoken to uncompressed
+		EnableCompression: cfg.WowzaCompression,
+	}
+	if cfg.WowzaSubprotocol != "" {
+		dialer.Subprotocols = []string{cfg.WowzaSubprotocol}
+	}
+	proxyURL, err := cfg.wowzaProxy()
+	if err != nil {
+		return nil, nil, err
+	}
+	if proxyURL != nil {
+		dialer.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	conn, resp, err := dialer.DialContext(ctx, wsURL, cfg.WowzaDialHeader())
+	if err != nil {
+		return nil, nil, fmt.Errorf("websocket dial: %w", err)
+	}
+
+	// A server that ignores the requested subprotocol would fail later in confusing ways
+	if want := cfg.WowzaSubprotocol; want != "" && conn.Subprotocol() != want {
+		conn.Close()
+		return nil, nil, fmt.Errorf("websocket dial: %w: got %q, want %q", errSubprotocolMismatch, conn.Subprotocol(), want)
+	}
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(timeout)
+	}
+	conn.SetReadDeadline(deadline)
+	conn.SetWriteDeadline(deadline)
+	if limit := cfg.MaxWowzaMessageSize; limit > 0 {
+		conn.SetReadLimit(int64(limit))
+	}
+
+	return conn, resp, nil
+}
+
+// errWowzaMessageTooLarge is returned by readWowzaJSON for a message past
+// MaxWowzaMessageSize.
+var errWowzaMessageTooLarge = errors.New("wowza message exceeds MAX_WOWZA_MESSAGE_SIZE")
+
+// readWowzaJSON reads one JSON message from conn, telling a message cut off by
+// the read limit apart from one that arrived whole but isn't valid JSON, since
+// both otherwise surface as a decoding error. Transport errors pass through.
+func readWowzaJSON(conn *websocket.Conn, v any) error {
+	err := conn.ReadJSON(v)
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, websocket.ErrReadLimit):
+		return errWowzaMessageTooLarge
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return fmt.Errorf("malformed JSON from Wowza: %w", err)
+	}
+	return err
+}
+
+// compressionNegotiated reports whether Wowza accepted permessage-deflate in
+// its handshake response.
+func compressionNegotiated(resp *http.Response) bool {
+	return strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+}
+
+// startPinger pings Wowza every interval until stop is called. Each pong pushes
+// the read deadline to two intervals out, never earlier than deadline, so a slow
+// but live Wowza isn't cut off while a silent connection still times out.
+func startPinger(conn *websocket.Conn, interval time.Duration, deadline time.Time) (stop func()) {
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(maxTime(deadline, time.Now().Add(2*interval)))
+	})
+	return keepAlive(conn, interval)
+}
+
+// keepAlive pings Wowza every interval until stop is called, without touching
+// the read deadline.
+func keepAlive(conn *websocket.Conn, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(interval)); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+// phaseDeadline sets conn's read and write deadlines to d from now, or ctx's
+// deadline if that comes first, and returns the deadline set.
+func phaseDeadline(ctx context.Context, conn *websocket.Conn, d time.Duration) time.Time {
+	deadline := time.Now().Add(d)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	conn.SetReadDeadline(deadline)
+	conn.SetWriteDeadline(deadline)
+	return deadline
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// closeGracefully sends a normal closure before closing conn, so Wowza can drop
+// whatever it set up for getOffer right away instead of noticing a dead socket.
+func closeGracefully(conn *websocket.Conn) {
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	conn.Close()
+}
+
 // cleanWowzaCandidate fixes Wowza Cloud candidate format issues
 func cleanWowzaCandidate(candidate string) string {
 	// Remove "generation X" suffix (non-standard)
@@ -65,5 +283,57 @@ func cleanWowzaCandidate(candidate string) string {
 		}
 	}
 
-	return candidate
+	return normalizeRelatedAddress(candidate)
+}
+
+// normalizeRelatedAddress fixes a candidate's raddr/rport pair and moves it
+// right after the type, where RFC 8839 puts it. Host candidates have no related
+// address, so one there is dropped. On srflx and relay candidates a pair with
+// an unparsable address or port, or only one half present, becomes 0.0.0.0 /
+// 0, which browsers also send when they don't disclose the base. The
+// connection address is left alone.
+func normalizeRelatedAddress(candidate string) string {
+	fields := strings.Fields(candidate)
+	start := slices.Index(fields, "typ") + 2
+	if start < 2 || start > len(fields) || len(fields) < 5 {
+		return candidate
+	}
+
+	var raddr, rport string
+	found := false
+	var rest []string
+	for i := start; i < len(fields); i++ {
+		key := fields[i]
+		if key != "raddr" && key != "rport" {
+			rest = append(rest, key)
+			continue
+		}
+		found = true
+		value := ""
+		if i+1 < len(fields) && fields[i+1] != "raddr" && fields[i+1] != "rport" {
+			value = fields[i+1]
+			i++
+		}
+		if key == "raddr" {
+			raddr = value
+		} else {
+			rport = value
+		}
+	}
+	if !found {
+		return candidate
+	}
+
+	out := slices.Clone(fields[:start])
+	if fields[start-1] != "host" {
+		port, err := strconv.Atoi(rport)
+		if net.ParseIP(raddr) == nil || err != nil || port < 0 || port > 65535 {
+			raddr, rport = "0.0.0.0", "0"
+			if ip := net.ParseIP(fields[4]); ip != nil && ip.To4() == nil {
+				raddr = "::"
+			}
+		}
+		out = append(out, "raddr", raddr, "rport", rport)
+	}
+	return strings.Join(append(out, rest...), " ")
 }
@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+func TestNormalizeRelatedAddress(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{
+			name: "well-formed srflx unchanged",
+			in:   "candidate:1 1 udp 1686052607 203.0.113.5 50000 typ srflx raddr 10.0.0.5 rport 50000 generation 0",
+			want: "candidate:1 1 udp 1686052607 203.0.113.5 50000 typ srflx raddr 10.0.0.5 rport 50000 generation 0",
+		},
+		{
+			name: "no related address",
+			in:   "candidate:1 1 udp 2130706431 203.0.113.5 50000 typ host generation 0",
+			want: "candidate:1 1 udp 2130706431 203.0.113.5 50000 typ host generation 0",
+		},
+		{
+			name: "moved after type",
+			in:   "candidate:1 1 udp 1686052607 203.0.113.5 50000 typ srflx generation 0 raddr 10.0.0.5 rport 50000",
+			want: "candidate:1 1 udp 1686052607 203.0.113.5 50000 typ srflx raddr 10.0.0.5 rport 50000 generation 0",
+		},
+		{
+			name: "missing rport",
+			in:   "candidate:1 1 udp 1686052607 203.0.113.5 50000 typ srflx raddr 10.0.0.5",
+			want: "candidate:1 1 udp 1686052607 203.0.113.5 50000 typ srflx raddr 0.0.0.0 rport 0",
+		},
+		{
+			name: "missing raddr",
+			in:   "candidate:1 1 udp 1686052607 203.0.113.5 50000 typ relay rport 50000",
+			want: "candidate:1 1 udp 1686052607 203.0.113.5 50000 typ relay raddr 0.0.0.0 rport 0",
+		},
+		{
+			name: "non-IP raddr",
+			in:   "candidate:1 1 udp 1686052607 203.0.113.5 50000 typ srflx raddr wowza.local rport 50000",
+			want: "candidate:1 1 udp 1686052607 203.0.113.5 50000 typ srflx raddr 0.0.0.0 rport 0",
+		},
+		{
+			name: "raddr with no value before rport",
+			in:   "candidate:1 1 udp 1686052607 203.0.113.5 50000 typ srflx raddr rport 50000",
+			want: "candidate:1 1 udp 1686052607 203.0.113.5 50000 typ srflx raddr 0.0.0.0 rport 0",
+		},
+		{
+			name: "raddr with no value at end",
+			in:   "candidate:1 1 udp 1686052607 203.0.113.5 50000 typ srflx raddr",
+			want: "candidate:1 1 udp 1686052607 203.0.113.5 50000 typ srflx raddr 0.0.0.0 rport 0",
+		},
+		{
+			name: "rport out of range",
+			in:   "candidate:1 1 udp 1686052607 203.0.113.5 50000 typ srflx raddr 10.0.0.5 rport 70000",
+			want: "candidate:1 1 udp 1686052607 203.0.113.5 50000 typ srflx raddr 0.0.0.0 rport 0",
+		},
+		{
+			name: "IPv6 connection address",
+			in:   "candidate:1 1 udp 1686052607 2001:db8::5 50000 typ srflx raddr bogus rport 1",
+			want: "candidate:1 1 udp 1686052607 2001:db8::5 50000 typ srflx raddr :: rport 0",
+		},
+		{
+			name: "dropped from host",
+			in:   "candidate:1 1 udp 2130706431 203.0.113.5 50000 typ host raddr 0.0.0.0 rport 0 generation 0",
+			want: "candidate:1 1 udp 2130706431 203.0.113.5 50000 typ host generation 0",
+		},
+		{
+			name: "no typ",
+			in:   "candidate:1 1 udp 1686052607 203.0.113.5 50000 raddr bogus",
+			want: "candidate:1 1 udp 1686052607 203.0.113.5 50000 raddr bogus",
+		},
+		{
+			name: "typ without value",
+			in:   "candidate:1 1 udp 1686052607 203.0.113.5 50000 typ",
+			want: "candidate:1 1 udp 1686052607 203.0.113.5 50000 typ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeRelatedAddress(tt.in); got != tt.want {
+				t.Errorf("normalizeRelatedAddress(%q)\n got %q\nwant %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}